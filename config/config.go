@@ -3,6 +3,8 @@ package config
 import (
 	"encoding/json"
 	"flag"
+	"fmt"
+	"net/url"
 	"os"
 	"regexp"
 	"runtime"
@@ -38,7 +40,41 @@ const (
   "CONCURRENCY": 262144,
   "DISABLE_KEEPALIVE": false,
   "CACHE_TTL": 259200,
-  "MAX_CACHE_SIZE": 0
+  "MAX_CACHE_SIZE": 0,
+  "SIGNATURE_SECRET": "",
+  "SIGNATURE_FALLBACK": "reject",
+  "MIN_QUALITY": 1,
+  "MAX_QUALITY": 100,
+  "WEBP_OPTIONS": {"QUALITY": 0, "EFFORT": 0, "LOSSLESS": false},
+  "AVIF_OPTIONS": {"QUALITY": 0, "EFFORT": 0, "LOSSLESS": false},
+  "JXL_OPTIONS": {"QUALITY": 0, "EFFORT": 1, "LOSSLESS": false},
+  "PRESETS": {},
+  "PRESETS_ONLY": false,
+  "ENABLE_PATH_PARAMS": false,
+  "IMG_MAP_OPTIONS": {},
+  "CACHE_CONTROL": "",
+  "ADMIN_LISTEN": "",
+  "ADMIN_TOKEN": "",
+  "READY_CHECK_REMOTE": false,
+  "SHUTDOWN_TIMEOUT": 30,
+  "CONVERT_WORKERS": 0,
+  "CONVERT_QUEUE_SIZE": 100,
+  "OVERLOAD_POLICY": "wait",
+  "SHARED_CACHE_LOCKS": false,
+  "LOCK_STALE_TIMEOUT": 60,
+  "UPSTREAM": {
+    "CONNECT_TIMEOUT": 10,
+    "READ_TIMEOUT": 60,
+    "MAX_BODY_SIZE": 100,
+    "MAX_CONNS_PER_HOST": 64,
+    "PROXY": "",
+    "CA_FILE": ""
+  },
+  "IMG_PATH_OPTIONS": {},
+  "REMOTE_MIN_TTL": 0,
+  "REMOTE_MAX_TTL": 0,
+  "REMOTE_STALE_WHILE_REVALIDATE": 0,
+  "REMOTE_STALE_IF_ERROR": 86400
 }`
 )
 
@@ -55,11 +91,13 @@ var (
 	AllowNonImage       bool
 	Config              = NewWebPConfig()
 	Version             = "0.15.2"
-	WriteLock           = cache.New(5*time.Minute, 10*time.Minute)
-	ConvertLock         = cache.New(5*time.Minute, 10*time.Minute)
 	LocalHostAlias      = "local"
 	RemoteCache         *cache.Cache
 	DefaultAllowedTypes = []string{"jpg", "png", "jpeg", "bmp", "gif", "svg", "nef", "heic", "webp", "avif", "jxl"} // Default allowed image types
+	OutputFormats       = []string{"webp", "avif", "jxl", "original"}                                               // Valid values of format= extra param
+	FitModes            = []string{"cover", "contain", "fill", "inside", "outside"}                                 // Valid values of fit= extra param
+	// Valid values of gravity= extra param, smart and entropy use libvips crop strategies
+	Gravities = []string{"north", "northeast", "east", "southeast", "south", "southwest", "west", "northwest", "centre", "smart", "entropy"}
 )
 
 type ImageMeta struct {
@@ -77,14 +115,54 @@ type MetaFile struct {
 	Path     string `json:"path"`     // local: path with width and height, proxy: full url
 	Checksum string `json:"checksum"` // hash of original file or hash(etag). Use this to identify changes
 
+	// Validators of the upstream response in proxy mode, sent back in conditional requests
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+	// Upstream sent must-revalidate, so the file can't be served once stale if the upstream fails
+	MustRevalidate bool `json:"must_revalidate,omitempty"`
+	// Unix time the fetched file is fresh until, 0 if it never expires or is unknown
+	FreshUntil int64 `json:"fresh_until,omitempty"`
+
 	ImageMeta
 }
 
+// MapOptions are settings of a single IMG_MAP entry, or of IMG_PATH in IMG_PATH_OPTIONS.
+// Upstream request settings only apply to remote targets. Remote images are cached by URL and shared
+// by all clients, so the upstream must not return different images depending on forwarded headers.
+type MapOptions struct {
+	CacheControl string `json:"CACHE_CONTROL"` // Overrides CACHE_CONTROL for images of this entry
+
+	Headers        map[string]string `json:"HEADERS"`         // Static headers sent to the upstream
+	UserAgent      string            `json:"USER_AGENT"`      // User-Agent sent to the upstream, empty means WebP Server Go's own
+	BearerToken    string            `json:"BEARER_TOKEN"`    // Sent as Authorization: Bearer
+	BasicAuth      string            `json:"BASIC_AUTH"`      // "user:password", sent as Authorization: Basic if there's no BEARER_TOKEN
+	ForwardHeaders []string          `json:"FORWARD_HEADERS"` // Client request headers forwarded to the upstream, responses to forwarded Cookie or Authorization are not cached
+}
+
+// FormatOptions are encoder settings of a single output format
+type FormatOptions struct {
+	Quality  int  `json:"QUALITY"`  // 0 means QUALITY in config
+	Effort   int  `json:"EFFORT"`   // CPU effort, WebP: 0-6, AVIF: 0-9, JXL: 1-9
+	Lossless bool `json:"LOSSLESS"` // Quality >= 100 is also lossless
+}
+
+// UpstreamOptions are settings of the HTTP client fetching images from remote backends
+type UpstreamOptions struct {
+	ConnectTimeout  int    `json:"CONNECT_TIMEOUT"`    // In seconds, for TCP and TLS handshake
+	ReadTimeout     int    `json:"READ_TIMEOUT"`       // In seconds, for the whole response including body
+	MaxBodySize     int    `json:"MAX_BODY_SIZE"`      // In MB, larger remote images are rejected, 0 means no limit
+	MaxConnsPerHost int    `json:"MAX_CONNS_PER_HOST"` // Connection pool size per remote host, 0 means no limit
+	Proxy           string `json:"PROXY"`              // Outbound proxy URL, empty means HTTP_PROXY/HTTPS_PROXY from env
+	CAFile          string `json:"CA_FILE"`            // PEM bundle trusted in addition to system CAs
+}
+
 type WebpConfig struct {
 	Host          string            `json:"HOST"`
 	Port          string            `json:"PORT"`
 	ImgPath       string            `json:"IMG_PATH"`
 	Quality       int               `json:"QUALITY,string"`
+	MinQuality    int               `json:"MIN_QUALITY"` // Lower bound of quality= extra param
+	MaxQuality    int               `json:"MAX_QUALITY"` // Upper bound of quality= extra param
 	AllowedTypes  []string          `json:"ALLOWED_TYPES"`
 	ConvertTypes  []string          `json:"CONVERT_TYPES"`
 	ImageMap      map[string]string `json:"IMG_MAP"`
@@ -96,14 +174,51 @@ type WebpConfig struct {
 	EnableAVIF bool `json:"ENABLE_AVIF"`
 	EnableJXL  bool `json:"ENABLE_JXL"`
 
+	WebpOptions FormatOptions `json:"WEBP_OPTIONS"`
+	AvifOptions FormatOptions `json:"AVIF_OPTIONS"`
+	JxlOptions  FormatOptions `json:"JXL_OPTIONS"`
+
 	EnableExtraParams          bool   `json:"ENABLE_EXTRA_PARAMS"`
+	EnablePathParams           bool   `json:"ENABLE_PATH_PARAMS"` // Accept extra params in a path prefix like /_/w_300,h_200/tsuki.jpg
 	ExtraParamsCropInteresting string `json:"EXTRA_PARAMS_CROP_INTERESTING"`
 
+	Presets     map[string]Preset `json:"PRESETS"`      // Named extra params selectable with preset=
+	PresetsOnly bool              `json:"PRESETS_ONLY"` // Ignore raw extra params, only preset= is used
+
+	SignatureSecret   string `json:"SIGNATURE_SECRET"`   // If set, requests with extra params must carry a valid sig
+	SignatureFallback string `json:"SIGNATURE_FALLBACK"` // "reject" unsigned requests with 403, or serve them in "original" size
+
+	ImageMapOptions map[string]MapOptions `json:"IMG_MAP_OPTIONS"`  // Per IMG_MAP entry settings, keyed by IMG_MAP key
+	ImgPathOptions  MapOptions            `json:"IMG_PATH_OPTIONS"` // Settings of images in IMG_PATH, i.e. not matching any IMG_MAP entry
+	CacheControl    string                `json:"CACHE_CONTROL"`    // Cache-Control header of images, empty means not set
+
+	AdminListen string `json:"ADMIN_LISTEN"` // Listen address of admin API, e.g. 127.0.0.1:3334, empty means disabled
+	AdminToken  string `json:"ADMIN_TOKEN"`  // Bearer token required by admin API
+
+	ReadyCheckRemote bool `json:"READY_CHECK_REMOTE"` // /readyz also checks remote IMG_PATH is reachable
+
+	ShutdownTimeout int `json:"SHUTDOWN_TIMEOUT"` // In seconds, for in-flight requests and conversions to finish on SIGTERM
+
+	ConvertWorkers   int    `json:"CONVERT_WORKERS"`    // Max encodes running at once, shared by requests and prefetch, 0 for one per CPU
+	ConvertQueueSize int    `json:"CONVERT_QUEUE_SIZE"` // Max requests waiting for workers before OVERLOAD_POLICY applies
+	OverloadPolicy   string `json:"OVERLOAD_POLICY"`    // "wait" regardless of queue size, serve "original" image, or "reject" with 503
+
+	SharedCacheLocks bool `json:"SHARED_CACHE_LOCKS"` // Use lock files for conversions and downloads, for cache paths shared by several processes
+	LockStaleTimeout int  `json:"LOCK_STALE_TIMEOUT"` // In seconds, lock files not refreshed for this long are taken over
+
+	Upstream UpstreamOptions `json:"UPSTREAM"`
+
 	StripMetadata    bool `json:"STRIP_METADATA"`
 	ReadBufferSize   int  `json:"READ_BUFFER_SIZE"`
 	Concurrency      int  `json:"CONCURRENCY"`
 	DisableKeepalive bool `json:"DISABLE_KEEPALIVE"`
-	CacheTTL         int  `json:"CACHE_TTL"` // In minutes
+	CacheTTL         int  `json:"CACHE_TTL"` // In minutes, remote images are revalidated after it if the upstream sends no Cache-Control or Expires
+
+	RemoteMinTTL int `json:"REMOTE_MIN_TTL"` // In seconds, lower bound of remote freshness from upstream Cache-Control or Expires
+	RemoteMaxTTL int `json:"REMOTE_MAX_TTL"` // In seconds, upper bound of it, 0 means no limit
+
+	RemoteStaleWhileRevalidate int `json:"REMOTE_STALE_WHILE_REVALIDATE"` // In seconds past freshness, a stale remote image is served while revalidated in background, 0 means disabled
+	RemoteStaleIfError         int `json:"REMOTE_STALE_IF_ERROR"`         // In seconds past freshness, a stale remote image is served if the upstream is down or returns 5xx
 
 	MaxCacheSize int `json:"MAX_CACHE_SIZE"` // In MB, for max cached exhausted/metadata files(plus remote-raw if applicable), 0 means no limit
 }
@@ -117,6 +232,8 @@ func NewWebPConfig() *WebpConfig {
 		Port:          "3333",
 		ImgPath:       "./pics",
 		Quality:       80,
+		MinQuality:    1,
+		MaxQuality:    100,
 		AllowedTypes:  defaultAllowedTypes,
 		ConvertTypes:  []string{"webp"},
 		ImageMap:      map[string]string{},
@@ -128,15 +245,50 @@ func NewWebPConfig() *WebpConfig {
 		EnableAVIF: false,
 		EnableJXL:  false,
 
+		WebpOptions: FormatOptions{Quality: 0, Effort: 0, Lossless: false},
+		AvifOptions: FormatOptions{Quality: 0, Effort: 0, Lossless: false},
+		JxlOptions:  FormatOptions{Quality: 0, Effort: 1, Lossless: false},
+
 		EnableExtraParams:          false,
+		EnablePathParams:           false,
 		ExtraParamsCropInteresting: "InterestingAttention",
+		SignatureSecret:            "",
+		Presets:                    map[string]Preset{},
+		PresetsOnly:                false,
+		SignatureFallback:          "reject",
 		StripMetadata:              true,
 		ReadBufferSize:             4096,
 		Concurrency:                262144,
 		DisableKeepalive:           false,
 		CacheTTL:                   259200,
 
+		RemoteMinTTL: 0,
+		RemoteMaxTTL: 0,
+
+		RemoteStaleWhileRevalidate: 0,
+		RemoteStaleIfError:         86400,
+
 		MaxCacheSize: 0,
+
+		ImageMapOptions: map[string]MapOptions{},
+		ImgPathOptions:  MapOptions{},
+		CacheControl:    "",
+
+		AdminListen: "",
+		AdminToken:  "",
+
+		ReadyCheckRemote: false,
+
+		ShutdownTimeout: 30,
+
+		ConvertWorkers:   runtime.NumCPU(),
+		ConvertQueueSize: 100,
+		OverloadPolicy:   "wait",
+
+		SharedCacheLocks: false,
+		LockStaleTimeout: 60,
+
+		Upstream: UpstreamOptions{ConnectTimeout: 10, ReadTimeout: 60, MaxBodySize: 100, MaxConnsPerHost: 64, Proxy: "", CAFile: ""},
 	}
 }
 
@@ -195,6 +347,26 @@ func LoadConfig() {
 			Config.Quality = quality
 		}
 	}
+	if os.Getenv("WEBP_MIN_QUALITY") != "" {
+		minQuality, err := strconv.Atoi(os.Getenv("WEBP_MIN_QUALITY"))
+		if err != nil {
+			log.Warnf("WEBP_MIN_QUALITY is not a valid integer, using value in config.json %d", Config.MinQuality)
+		} else {
+			Config.MinQuality = minQuality
+		}
+	}
+	if os.Getenv("WEBP_MAX_QUALITY") != "" {
+		maxQuality, err := strconv.Atoi(os.Getenv("WEBP_MAX_QUALITY"))
+		if err != nil {
+			log.Warnf("WEBP_MAX_QUALITY is not a valid integer, using value in config.json %d", Config.MaxQuality)
+		} else {
+			Config.MaxQuality = maxQuality
+		}
+	}
+	if Config.MinQuality > Config.MaxQuality {
+		log.Warnf("MIN_QUALITY %d is larger than MAX_QUALITY %d, using MAX_QUALITY as both", Config.MinQuality, Config.MaxQuality)
+		Config.MinQuality = Config.MaxQuality
+	}
 	if os.Getenv("WEBP_ALLOWED_TYPES") != "" {
 		Config.AllowedTypes = strings.Split(os.Getenv("WEBP_ALLOWED_TYPES"), ",")
 	}
@@ -216,6 +388,14 @@ func LoadConfig() {
 		}
 	}
 
+	loadFormatOptionsFromEnv("WEBP", &Config.WebpOptions)
+	loadFormatOptionsFromEnv("AVIF", &Config.AvifOptions)
+	loadFormatOptionsFromEnv("JXL", &Config.JxlOptions)
+	clampEffort("WEBP", &Config.WebpOptions, 0, 6)
+	clampEffort("AVIF", &Config.AvifOptions, 0, 9)
+	clampEffort("JXL", &Config.JxlOptions, 1, 9)
+	loadUpstreamOptionsFromEnv(&Config.Upstream)
+
 	if os.Getenv("WEBP_ENABLE_EXTRA_PARAMS") != "" {
 		enableExtraParams := os.Getenv("WEBP_ENABLE_EXTRA_PARAMS")
 		switch enableExtraParams {
@@ -227,6 +407,17 @@ func LoadConfig() {
 			log.Warnf("WEBP_ENABLE_EXTRA_PARAMS is not a valid boolean, using value in config.json %t", Config.EnableExtraParams)
 		}
 	}
+	if os.Getenv("WEBP_ENABLE_PATH_PARAMS") != "" {
+		enablePathParams := os.Getenv("WEBP_ENABLE_PATH_PARAMS")
+		switch enablePathParams {
+		case "true":
+			Config.EnablePathParams = true
+		case "false":
+			Config.EnablePathParams = false
+		default:
+			log.Warnf("WEBP_ENABLE_PATH_PARAMS is not a valid boolean, using value in config.json %t", Config.EnablePathParams)
+		}
+	}
 	if os.Getenv("WEBP_EXTRA_PARAMS_CROP_INTERESTING") != "" {
 		cropInteresting := os.Getenv("WEBP_EXTRA_PARAMS_CROP_INTERESTING")
 		switch cropInteresting {
@@ -249,6 +440,114 @@ func LoadConfig() {
 		}
 	}
 
+	if os.Getenv("WEBP_PRESETS_ONLY") != "" {
+		presetsOnly := os.Getenv("WEBP_PRESETS_ONLY")
+		switch presetsOnly {
+		case "true":
+			Config.PresetsOnly = true
+		case "false":
+			Config.PresetsOnly = false
+		default:
+			log.Warnf("WEBP_PRESETS_ONLY is not a valid boolean, using value in config.json %t", Config.PresetsOnly)
+		}
+	}
+
+	if os.Getenv("WEBP_SIGNATURE_SECRET") != "" {
+		Config.SignatureSecret = os.Getenv("WEBP_SIGNATURE_SECRET")
+	}
+	if os.Getenv("WEBP_SIGNATURE_FALLBACK") != "" {
+		Config.SignatureFallback = os.Getenv("WEBP_SIGNATURE_FALLBACK")
+	}
+	switch Config.SignatureFallback {
+	case "reject", "original":
+	default:
+		log.Warnf("SIGNATURE_FALLBACK %s is not valid, using reject", Config.SignatureFallback)
+		Config.SignatureFallback = "reject"
+	}
+
+	if os.Getenv("WEBP_ADMIN_LISTEN") != "" {
+		Config.AdminListen = os.Getenv("WEBP_ADMIN_LISTEN")
+	}
+	if os.Getenv("WEBP_ADMIN_TOKEN") != "" {
+		Config.AdminToken = os.Getenv("WEBP_ADMIN_TOKEN")
+	}
+	if os.Getenv("WEBP_READY_CHECK_REMOTE") != "" {
+		readyCheckRemote := os.Getenv("WEBP_READY_CHECK_REMOTE")
+		switch readyCheckRemote {
+		case "true":
+			Config.ReadyCheckRemote = true
+		case "false":
+			Config.ReadyCheckRemote = false
+		default:
+			log.Warnf("WEBP_READY_CHECK_REMOTE is not a valid boolean, using value in config.json %t", Config.ReadyCheckRemote)
+		}
+	}
+	if os.Getenv("WEBP_SHUTDOWN_TIMEOUT") != "" {
+		shutdownTimeout, err := strconv.Atoi(os.Getenv("WEBP_SHUTDOWN_TIMEOUT"))
+		if err != nil {
+			log.Warnf("WEBP_SHUTDOWN_TIMEOUT is not a valid integer, using value in config.json %d", Config.ShutdownTimeout)
+		} else {
+			Config.ShutdownTimeout = shutdownTimeout
+		}
+	}
+	if os.Getenv("WEBP_CONVERT_WORKERS") != "" {
+		convertWorkers, err := strconv.Atoi(os.Getenv("WEBP_CONVERT_WORKERS"))
+		if err != nil {
+			log.Warnf("WEBP_CONVERT_WORKERS is not a valid integer, using value in config.json %d", Config.ConvertWorkers)
+		} else {
+			Config.ConvertWorkers = convertWorkers
+		}
+	}
+	if Config.ConvertWorkers < 0 {
+		log.Warnf("CONVERT_WORKERS %d is not valid, using %d", Config.ConvertWorkers, runtime.NumCPU())
+	}
+	if Config.ConvertWorkers < 1 {
+		Config.ConvertWorkers = runtime.NumCPU()
+	}
+	if os.Getenv("WEBP_CONVERT_QUEUE_SIZE") != "" {
+		convertQueueSize, err := strconv.Atoi(os.Getenv("WEBP_CONVERT_QUEUE_SIZE"))
+		if err != nil {
+			log.Warnf("WEBP_CONVERT_QUEUE_SIZE is not a valid integer, using value in config.json %d", Config.ConvertQueueSize)
+		} else {
+			Config.ConvertQueueSize = convertQueueSize
+		}
+	}
+	if os.Getenv("WEBP_OVERLOAD_POLICY") != "" {
+		Config.OverloadPolicy = os.Getenv("WEBP_OVERLOAD_POLICY")
+	}
+	switch Config.OverloadPolicy {
+	case "wait", "original", "reject":
+	default:
+		log.Warnf("OVERLOAD_POLICY %s is not valid, using wait", Config.OverloadPolicy)
+		Config.OverloadPolicy = "wait"
+	}
+	if os.Getenv("WEBP_SHARED_CACHE_LOCKS") != "" {
+		sharedCacheLocks := os.Getenv("WEBP_SHARED_CACHE_LOCKS")
+		switch sharedCacheLocks {
+		case "true":
+			Config.SharedCacheLocks = true
+		case "false":
+			Config.SharedCacheLocks = false
+		default:
+			log.Warnf("WEBP_SHARED_CACHE_LOCKS is not a valid boolean, using value in config.json %t", Config.SharedCacheLocks)
+		}
+	}
+	if os.Getenv("WEBP_LOCK_STALE_TIMEOUT") != "" {
+		lockStaleTimeout, err := strconv.Atoi(os.Getenv("WEBP_LOCK_STALE_TIMEOUT"))
+		if err != nil {
+			log.Warnf("WEBP_LOCK_STALE_TIMEOUT is not a valid integer, using value in config.json %d", Config.LockStaleTimeout)
+		} else {
+			Config.LockStaleTimeout = lockStaleTimeout
+		}
+	}
+	if Config.LockStaleTimeout < 1 {
+		log.Warnf("LOCK_STALE_TIMEOUT %d is not valid, using 60", Config.LockStaleTimeout)
+		Config.LockStaleTimeout = 60
+	}
+	if os.Getenv("WEBP_CACHE_CONTROL") != "" {
+		Config.CacheControl = os.Getenv("WEBP_CACHE_CONTROL")
+	}
+
 	if os.Getenv("WEBP_STRIP_METADATA") != "" {
 		stripMetadata := os.Getenv("WEBP_STRIP_METADATA")
 		switch stripMetadata {
@@ -298,6 +597,38 @@ func LoadConfig() {
 			Config.CacheTTL = cacheTTL
 		}
 	}
+	if os.Getenv("WEBP_REMOTE_MIN_TTL") != "" {
+		remoteMinTTL, err := strconv.Atoi(os.Getenv("WEBP_REMOTE_MIN_TTL"))
+		if err != nil {
+			log.Warnf("WEBP_REMOTE_MIN_TTL is not a valid integer, using value in config.json %d", Config.RemoteMinTTL)
+		} else {
+			Config.RemoteMinTTL = remoteMinTTL
+		}
+	}
+	if os.Getenv("WEBP_REMOTE_MAX_TTL") != "" {
+		remoteMaxTTL, err := strconv.Atoi(os.Getenv("WEBP_REMOTE_MAX_TTL"))
+		if err != nil {
+			log.Warnf("WEBP_REMOTE_MAX_TTL is not a valid integer, using value in config.json %d", Config.RemoteMaxTTL)
+		} else {
+			Config.RemoteMaxTTL = remoteMaxTTL
+		}
+	}
+	if os.Getenv("WEBP_REMOTE_STALE_WHILE_REVALIDATE") != "" {
+		staleWhileRevalidate, err := strconv.Atoi(os.Getenv("WEBP_REMOTE_STALE_WHILE_REVALIDATE"))
+		if err != nil {
+			log.Warnf("WEBP_REMOTE_STALE_WHILE_REVALIDATE is not a valid integer, using value in config.json %d", Config.RemoteStaleWhileRevalidate)
+		} else {
+			Config.RemoteStaleWhileRevalidate = staleWhileRevalidate
+		}
+	}
+	if os.Getenv("WEBP_REMOTE_STALE_IF_ERROR") != "" {
+		staleIfError, err := strconv.Atoi(os.Getenv("WEBP_REMOTE_STALE_IF_ERROR"))
+		if err != nil {
+			log.Warnf("WEBP_REMOTE_STALE_IF_ERROR is not a valid integer, using value in config.json %d", Config.RemoteStaleIfError)
+		} else {
+			Config.RemoteStaleIfError = staleIfError
+		}
+	}
 
 	if Config.CacheTTL == 0 {
 		RemoteCache = cache.New(cache.NoExpiration, 10*time.Minute)
@@ -323,6 +654,89 @@ func LoadConfig() {
 	log.Debugln("Config", Config)
 }
 
+// loadFormatOptionsFromEnv overrides options with WEBP_<FORMAT>_QUALITY, WEBP_<FORMAT>_EFFORT and WEBP_<FORMAT>_LOSSLESS
+func loadFormatOptionsFromEnv(format string, options *FormatOptions) {
+	prefix := "WEBP_" + format + "_"
+	if os.Getenv(prefix+"QUALITY") != "" {
+		quality, err := strconv.Atoi(os.Getenv(prefix + "QUALITY"))
+		if err != nil {
+			log.Warnf("%sQUALITY is not a valid integer, using value in config.json %d", prefix, options.Quality)
+		} else {
+			options.Quality = quality
+		}
+	}
+	if os.Getenv(prefix+"EFFORT") != "" {
+		effort, err := strconv.Atoi(os.Getenv(prefix + "EFFORT"))
+		if err != nil {
+			log.Warnf("%sEFFORT is not a valid integer, using value in config.json %d", prefix, options.Effort)
+		} else {
+			options.Effort = effort
+		}
+	}
+	if os.Getenv(prefix+"LOSSLESS") != "" {
+		lossless := os.Getenv(prefix + "LOSSLESS")
+		switch lossless {
+		case "true":
+			options.Lossless = true
+		case "false":
+			options.Lossless = false
+		default:
+			log.Warnf("%sLOSSLESS is not a valid boolean, using value in config.json %t", prefix, options.Lossless)
+		}
+	}
+}
+
+// loadUpstreamOptionsFromEnv overrides options with WEBP_UPSTREAM_<OPTION>
+func loadUpstreamOptionsFromEnv(options *UpstreamOptions) {
+	if os.Getenv("WEBP_UPSTREAM_CONNECT_TIMEOUT") != "" {
+		connectTimeout, err := strconv.Atoi(os.Getenv("WEBP_UPSTREAM_CONNECT_TIMEOUT"))
+		if err != nil {
+			log.Warnf("WEBP_UPSTREAM_CONNECT_TIMEOUT is not a valid integer, using value in config.json %d", options.ConnectTimeout)
+		} else {
+			options.ConnectTimeout = connectTimeout
+		}
+	}
+	if os.Getenv("WEBP_UPSTREAM_READ_TIMEOUT") != "" {
+		readTimeout, err := strconv.Atoi(os.Getenv("WEBP_UPSTREAM_READ_TIMEOUT"))
+		if err != nil {
+			log.Warnf("WEBP_UPSTREAM_READ_TIMEOUT is not a valid integer, using value in config.json %d", options.ReadTimeout)
+		} else {
+			options.ReadTimeout = readTimeout
+		}
+	}
+	if os.Getenv("WEBP_UPSTREAM_MAX_BODY_SIZE") != "" {
+		maxBodySize, err := strconv.Atoi(os.Getenv("WEBP_UPSTREAM_MAX_BODY_SIZE"))
+		if err != nil {
+			log.Warnf("WEBP_UPSTREAM_MAX_BODY_SIZE is not a valid integer, using value in config.json %d", options.MaxBodySize)
+		} else {
+			options.MaxBodySize = maxBodySize
+		}
+	}
+	if os.Getenv("WEBP_UPSTREAM_MAX_CONNS_PER_HOST") != "" {
+		maxConnsPerHost, err := strconv.Atoi(os.Getenv("WEBP_UPSTREAM_MAX_CONNS_PER_HOST"))
+		if err != nil {
+			log.Warnf("WEBP_UPSTREAM_MAX_CONNS_PER_HOST is not a valid integer, using value in config.json %d", options.MaxConnsPerHost)
+		} else {
+			options.MaxConnsPerHost = maxConnsPerHost
+		}
+	}
+	if os.Getenv("WEBP_UPSTREAM_PROXY") != "" {
+		options.Proxy = os.Getenv("WEBP_UPSTREAM_PROXY")
+	}
+	if os.Getenv("WEBP_UPSTREAM_CA_FILE") != "" {
+		options.CAFile = os.Getenv("WEBP_UPSTREAM_CA_FILE")
+	}
+}
+
+// clampEffort keeps EFFORT of format within minEffort-maxEffort accepted by its encoder
+func clampEffort(format string, options *FormatOptions, minEffort, maxEffort int) {
+	if options.Effort < minEffort || options.Effort > maxEffort {
+		effort := min(max(options.Effort, minEffort), maxEffort)
+		log.Warnf("%s_OPTIONS EFFORT %d is not within %d-%d, using %d", format, options.Effort, minEffort, maxEffort, effort)
+		options.Effort = effort
+	}
+}
+
 func parseImgMap(imgMap map[string]string) map[string]string {
 	var parsedImgMap = map[string]string{}
 	httpRegexpMatcher := regexp.MustCompile(HttpRegexp)
@@ -338,9 +752,29 @@ func parseImgMap(imgMap map[string]string) map[string]string {
 	return parsedImgMap
 }
 
+// Preset is a named set of extra params in query param form, e.g. {"width": 320, "height": 180, "fit": "cover"}
+type Preset map[string]any
+
+// Query returns preset params as query values
+func (p Preset) Query() url.Values {
+	query := url.Values{}
+	for key, value := range p {
+		query.Set(key, fmt.Sprint(value))
+	}
+	return query
+}
+
 type ExtraParams struct {
-	Width     int // in px
-	Height    int // in px
-	MaxWidth  int // in px
-	MaxHeight int // in px
+	Width      int     // in px
+	Height     int     // in px
+	MaxWidth   int     // in px
+	MaxHeight  int     // in px
+	Format     string  // webp, avif, jxl or original, overrides content negotiation
+	Quality    int     // 1-100, within MIN_QUALITY and MAX_QUALITY, 0 means QUALITY in config
+	Fit        string  // cover, contain, fill, inside or outside when both Width and Height are set, default is cover
+	Background string  // hex RGB(A) color of padded area for contain fit, e.g. ffffff
+	Gravity    string  // crop anchor for cover fit, one of Gravities or focalpoint, default is EXTRA_PARAMS_CROP_INTERESTING
+	FocalX     float64 // 0-1 from left, used when Gravity is focalpoint
+	FocalY     float64 // 0-1 from top, used when Gravity is focalpoint
+	Dpr        float64 // 1-4, dimensions above are already multiplied by it, results larger than the source are capped at source size
 }
@@ -1,6 +1,8 @@
 package config
 
 import (
+	"encoding/json"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -18,11 +20,89 @@ func TestLoadConfig(t *testing.T) {
 	assert.Equal(t, Config.Host, "127.0.0.1")
 	assert.Equal(t, Config.Port, "3333")
 	assert.Equal(t, Config.Quality, 80)
+	assert.Equal(t, Config.MinQuality, 1)
+	assert.Equal(t, Config.MaxQuality, 100)
 	assert.Equal(t, Config.ImgPath, "./pics")
 	assert.Equal(t, Config.ImageMap, map[string]string{})
 	assert.Equal(t, Config.ExhaustPath, "./exhaust")
 	assert.Equal(t, Config.CacheTTL, 259200)
+	assert.Equal(t, Config.RemoteMinTTL, 0)
+	assert.Equal(t, Config.RemoteMaxTTL, 0)
+	assert.Equal(t, Config.RemoteStaleWhileRevalidate, 0)
+	assert.Equal(t, Config.RemoteStaleIfError, 86400)
 	assert.Equal(t, Config.MaxCacheSize, 0)
+	assert.Equal(t, Config.Presets, map[string]Preset{})
+	assert.False(t, Config.PresetsOnly)
+	assert.Equal(t, Config.CacheControl, "")
+	assert.Equal(t, Config.ImageMapOptions, map[string]MapOptions{})
+	assert.Equal(t, Config.ImgPathOptions, MapOptions{})
+	assert.False(t, Config.ReadyCheckRemote)
+	assert.Equal(t, Config.ShutdownTimeout, 30)
+	assert.Equal(t, Config.OverloadPolicy, "wait")
+	assert.Equal(t, Config.ConvertQueueSize, 100)
+	assert.False(t, Config.SharedCacheLocks)
+	assert.Equal(t, Config.LockStaleTimeout, 60)
+	assert.Equal(t, Config.Upstream.MaxBodySize, 100)
+	assert.Equal(t, Config.JxlOptions, FormatOptions{Quality: 0, Effort: 1, Lossless: false})
+}
+
+func TestSampleConfig(t *testing.T) {
+	// -dump-config output has to be a valid config.json
+	decoder := json.NewDecoder(strings.NewReader(SampleConfig))
+	decoder.DisallowUnknownFields()
+	assert.NoError(t, decoder.Decode(NewWebPConfig()))
+}
+
+func TestLoadFormatOptionsFromEnv(t *testing.T) {
+	t.Setenv("WEBP_AVIF_QUALITY", "55")
+	t.Setenv("WEBP_AVIF_EFFORT", "4")
+	t.Setenv("WEBP_AVIF_LOSSLESS", "true")
+	t.Setenv("WEBP_JXL_QUALITY", "high")
+
+	avif := FormatOptions{Quality: 0, Effort: 0, Lossless: false}
+	loadFormatOptionsFromEnv("AVIF", &avif)
+	assert.Equal(t, FormatOptions{Quality: 55, Effort: 4, Lossless: true}, avif)
+
+	// Invalid value keeps value in config.json
+	jxl := FormatOptions{Quality: 70, Effort: 1, Lossless: false}
+	loadFormatOptionsFromEnv("JXL", &jxl)
+	assert.Equal(t, FormatOptions{Quality: 70, Effort: 1, Lossless: false}, jxl)
+}
+
+func TestClampEffort(t *testing.T) {
+	webp := FormatOptions{Quality: 80, Effort: 7}
+	clampEffort("WEBP", &webp, 0, 6)
+	assert.Equal(t, FormatOptions{Quality: 80, Effort: 6}, webp)
+
+	jxl := FormatOptions{Effort: 0}
+	clampEffort("JXL", &jxl, 1, 9)
+	assert.Equal(t, 1, jxl.Effort)
+
+	avif := FormatOptions{Effort: 9}
+	clampEffort("AVIF", &avif, 0, 9)
+	assert.Equal(t, 9, avif.Effort)
+
+	// Out of range values from env are clamped by LoadConfig too
+	t.Setenv("WEBP_WEBP_EFFORT", "9")
+	LoadConfig()
+	assert.Equal(t, 6, Config.WebpOptions.Effort)
+}
+
+func TestLoadUpstreamOptionsFromEnv(t *testing.T) {
+	t.Setenv("WEBP_UPSTREAM_CONNECT_TIMEOUT", "3")
+	t.Setenv("WEBP_UPSTREAM_MAX_BODY_SIZE", "big")
+	t.Setenv("WEBP_UPSTREAM_PROXY", "http://proxy.internal:3128")
+
+	upstream := NewWebPConfig().Upstream
+	loadUpstreamOptionsFromEnv(&upstream)
+	assert.Equal(t, UpstreamOptions{ConnectTimeout: 3, ReadTimeout: 60, MaxBodySize: 100, MaxConnsPerHost: 64, Proxy: "http://proxy.internal:3128"}, upstream)
+}
+
+func TestPresetQuery(t *testing.T) {
+	var presets map[string]Preset
+	err := json.Unmarshal([]byte(`{"thumb": {"width": 320, "height": 180, "fit": "cover", "fp_x": 0.25}}`), &presets)
+	assert.NoError(t, err)
+	assert.Equal(t, "fit=cover&fp_x=0.25&height=180&width=320", presets["thumb"].Query().Encode())
 }
 
 func TestParseImgMap(t *testing.T) {
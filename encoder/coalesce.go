@@ -0,0 +1,55 @@
+package encoder
+
+import (
+	"sync"
+	"webp_server_go/metrics"
+)
+
+// conversion is an in-flight encode of a single output file, shared by all requests for it
+type conversion struct {
+	done chan struct{}
+	err  error
+}
+
+// wait blocks until the conversion is finished, returning its error
+func (c *conversion) wait() error {
+	<-c.done
+	return c.err
+}
+
+// conversions coalesces concurrent encodes of the same output file, keyed by its path
+var conversions = struct {
+	sync.Mutex
+	inFlight map[string]*conversion
+}{inFlight: map[string]*conversion{}}
+
+// joinConversion returns the in-flight conversion of key, or starts one if there's none.
+// leader is true for the caller that started it, who has to call finishConversion.
+func joinConversion(key string) (c *conversion, leader bool) {
+	conversions.Lock()
+	defer conversions.Unlock()
+	if c, found := conversions.inFlight[key]; found {
+		return c, false
+	}
+	c = &conversion{done: make(chan struct{})}
+	conversions.inFlight[key] = c
+	metrics.SetConversionsInProgress(len(conversions.inFlight))
+	return c, true
+}
+
+// finishConversion wakes up all waiters of the conversion of key with err
+func finishConversion(key string, c *conversion, err error) {
+	conversions.Lock()
+	delete(conversions.inFlight, key)
+	metrics.SetConversionsInProgress(len(conversions.inFlight))
+	conversions.Unlock()
+	c.err = err
+	close(c.done)
+}
+
+// InProgress returns the number of output files under conversion
+func InProgress() int {
+	conversions.Lock()
+	defer conversions.Unlock()
+	return len(conversions.inFlight)
+}
@@ -0,0 +1,56 @@
+package encoder
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+	"webp_server_go/config"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJoinConversion(t *testing.T) {
+	first, leader := joinConversion("/exhaust/a.webp")
+	assert.True(t, leader)
+	second, leader := joinConversion("/exhaust/a.webp")
+	assert.False(t, leader)
+	assert.Same(t, first, second)
+	other, leader := joinConversion("/exhaust/a.avif")
+	assert.True(t, leader)
+	assert.Equal(t, 2, InProgress())
+
+	failed := errors.New("failed")
+	finishConversion("/exhaust/a.webp", first, failed)
+	assert.ErrorIs(t, second.wait(), failed)
+	finishConversion("/exhaust/a.avif", other, nil)
+	assert.NoError(t, other.wait())
+	assert.Equal(t, 0, InProgress())
+}
+
+func TestConvertFilterWaitsForInFlight(t *testing.T) {
+	oldConfig := *config.Config
+	defer func() { *config.Config = oldConfig }()
+	config.Config.EnableWebP = true
+	config.Config.EnableAVIF = false
+	config.Config.EnableJXL = false
+
+	dir := t.TempDir()
+	webpPath := filepath.Join(dir, "tsuki.webp")
+	conv, _ := joinConversion(webpPath)
+
+	result := make(chan error)
+	go func() {
+		result <- ConvertFilter("../pics/tsuki.jpg", filepath.Join(dir, "tsuki.jxl"), filepath.Join(dir, "tsuki.avif"), webpPath,
+			config.ExtraParams{}, map[string]bool{"webp": true}, nil)
+	}()
+	select {
+	case <-result:
+		t.Fatal("ConvertFilter returned before the in-flight conversion finished")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	failed := errors.New("failed")
+	finishConversion(webpPath, conv, failed)
+	assert.ErrorIs(t, <-result, failed)
+}
@@ -1,6 +1,8 @@
 package encoder
 
 import (
+	"errors"
+	"fmt"
 	"os"
 	"path"
 	"runtime"
@@ -9,6 +11,7 @@ import (
 	"time"
 	"webp_server_go/config"
 	"webp_server_go/helper"
+	"webp_server_go/metrics"
 
 	"github.com/davidbyttow/govips/v2/vips"
 	log "github.com/sirupsen/logrus"
@@ -33,6 +36,11 @@ func init() {
 	intMinusOne.Set(-1)
 }
 
+// Shutdown releases libvips, no conversion may run after it
+func Shutdown() {
+	vips.Shutdown()
+}
+
 func loadImage(filename string) (*vips.ImageRef, error) {
 	img, err := vips.LoadImageFromFile(filename, &vips.ImportParams{
 		FailOnError: boolFalse,
@@ -41,55 +49,108 @@ func loadImage(filename string) (*vips.ImageRef, error) {
 	return img, err
 }
 
-func ConvertFilter(rawPath, jxlPath, avifPath, webpPath string, extraParams config.ExtraParams, supportedFormats map[string]bool, c chan int) {
-	// Wait for the conversion to complete and return the converted image
-	retryDelay := 100 * time.Millisecond // Initial retry delay
+// convertJob is an encode of the source image to a single format
+type convertJob struct {
+	imageType     string
+	optimizedPath string
+}
 
-	for {
-		if _, found := config.ConvertLock.Get(rawPath); found {
-			log.Debugf("file %s is locked under conversion, retrying in %s", rawPath, retryDelay)
-			time.Sleep(retryDelay)
-		} else {
-			// The lock is released, indicating that the conversion is complete
-			break
-		}
+// ConvertFilter encodes rawPath to every enabled and supported format that is not in cache yet,
+// returning conversion errors of them joined.
+// Requests for an output file already under conversion wait for it instead of encoding it again.
+// c is only passed by prefetch, whose conversions yield to requests in the conversion pool.
+// ErrOverloaded is returned if the pool queue is full and OVERLOAD_POLICY isn't wait.
+func ConvertFilter(rawPath, jxlPath, avifPath, webpPath string, extraParams config.ExtraParams, supportedFormats map[string]bool, c chan int) error {
+	if c != nil {
+		defer func() { c <- 1 }()
 	}
 
-	// If there is a lock here, it means that another thread is converting the same image
-	// Lock rawPath to prevent concurrent conversion
-	config.ConvertLock.Set(rawPath, true, -1)
-	defer config.ConvertLock.Delete(rawPath)
+	enabled := map[string]bool{
+		"avif": config.Config.EnableAVIF,
+		"webp": config.Config.EnableWebP,
+		"jxl":  config.Config.EnableJXL,
+	}
+	var (
+		waiting []*conversion
+		leading []convertJob
+		started = map[string]*conversion{}
+	)
+	for _, job := range []convertJob{{"avif", avifPath}, {"webp", webpPath}, {"jxl", jxlPath}} {
+		if !enabled[job.imageType] || !supportedFormats[job.imageType] || helper.ImageExists(job.optimizedPath) {
+			continue
+		}
+		conv, leader := joinConversion(job.optimizedPath)
+		waiting = append(waiting, conv)
+		if !leader {
+			continue
+		}
+		if helper.ImageExists(job.optimizedPath) {
+			// Finished by another request between the check above and joining
+			finishConversion(job.optimizedPath, conv, nil)
+			continue
+		}
+		leading = append(leading, job)
+		started[job.optimizedPath] = conv
+	}
 
-	var wg sync.WaitGroup
-	if !helper.ImageExists(avifPath) && config.Config.EnableAVIF && supportedFormats["avif"] {
-		wg.Go(func() {
-			if err := convertImage(rawPath, avifPath, "avif", extraParams); err != nil {
-				log.Errorln(err)
+	if config.Config.SharedCacheLocks {
+		// Other processes sharing the cache directory may be encoding the same files
+		var locked []convertJob
+		for _, job := range leading {
+			unlock := helper.LockCacheFile(job.optimizedPath)
+			defer unlock()
+			if helper.ImageExists(job.optimizedPath) {
+				finishConversion(job.optimizedPath, started[job.optimizedPath], nil)
+				continue
 			}
-		})
+			locked = append(locked, job)
+		}
+		leading = locked
 	}
 
-	if !helper.ImageExists(webpPath) && config.Config.EnableWebP && supportedFormats["webp"] {
-		wg.Go(func() {
-			if err := convertImage(rawPath, webpPath, "webp", extraParams); err != nil {
-				log.Errorln(err)
+	if len(leading) > 0 {
+		// Formats share the workers taken, one encode per worker at a time
+		workers, err := pool.acquire(len(leading), c != nil)
+		if err != nil {
+			log.Warnf("conversion pool is overloaded, not converting %s", rawPath)
+			for _, job := range leading {
+				finishConversion(job.optimizedPath, started[job.optimizedPath], err)
 			}
-		})
+		} else {
+			runJobs(leading, workers, func(job convertJob) {
+				convErr := convertImage(rawPath, job.optimizedPath, job.imageType, extraParams)
+				if convErr != nil {
+					log.Errorln(convErr)
+				}
+				finishConversion(job.optimizedPath, started[job.optimizedPath], convErr)
+			})
+			pool.release(workers)
+		}
+	}
+
+	var errs []error
+	for _, conv := range waiting {
+		errs = append(errs, conv.wait())
 	}
+	return errors.Join(errs...)
+}
 
-	if !helper.ImageExists(jxlPath) && config.Config.EnableJXL && supportedFormats["jxl"] {
+// runJobs runs jobs on no more than workers goroutines, returning once all are done
+func runJobs(jobs []convertJob, workers int, run func(convertJob)) {
+	queue := make(chan convertJob, len(jobs))
+	for _, job := range jobs {
+		queue <- job
+	}
+	close(queue)
+	var wg sync.WaitGroup
+	for range min(workers, len(jobs)) {
 		wg.Go(func() {
-			if err := convertImage(rawPath, jxlPath, "jxl", extraParams); err != nil {
-				log.Errorln(err)
+			for job := range queue {
+				run(job)
 			}
 		})
 	}
-
 	wg.Wait()
-
-	if c != nil {
-		c <- 1
-	}
 }
 
 func convertImage(rawPath, optimizedPath, imageType string, extraParams config.ExtraParams) error {
@@ -139,45 +200,52 @@ func convertImage(rawPath, optimizedPath, imageType string, extraParams config.E
 			log.Infof("Image is already in WebP format, copying %s to %s", rawPath, optimizedPath)
 			return helper.CopyFile(rawPath, optimizedPath)
 		} else {
-			err = webpEncoder(img, rawPath, optimizedPath)
+			start := time.Now()
+			err = webpEncoder(img, rawPath, optimizedPath, extraParams)
+			metrics.ObserveConversion("webp", start)
 		}
 	case "avif":
 		if imageFormat == vips.ImageTypeAVIF {
 			log.Infof("Image is already in AVIF format, copying %s to %s", rawPath, optimizedPath)
 			return helper.CopyFile(rawPath, optimizedPath)
 		} else {
-			err = avifEncoder(img, rawPath, optimizedPath)
+			start := time.Now()
+			err = avifEncoder(img, rawPath, optimizedPath, extraParams)
+			metrics.ObserveConversion("avif", start)
 		}
 	case "jxl":
 		if imageFormat == vips.ImageTypeJXL {
 			log.Infof("Image is already in JXL format, copying %s to %s", rawPath, optimizedPath)
 			return helper.CopyFile(rawPath, optimizedPath)
 		} else {
-			err = jxlEncoder(img, rawPath, optimizedPath)
+			start := time.Now()
+			err = jxlEncoder(img, rawPath, optimizedPath, extraParams)
+			metrics.ObserveConversion("jxl", start)
 		}
 	}
 
 	return err
 }
 
-func jxlEncoder(img *vips.ImageRef, rawPath string, optimizedPath string) error {
+func jxlEncoder(img *vips.ImageRef, rawPath string, optimizedPath string, extraParams config.ExtraParams) error {
 	var (
 		buf     []byte
-		quality = config.Config.Quality
+		options = config.Config.JxlOptions
+		quality = encodeQuality(extraParams, options)
 		err     error
 	)
 
 	// If quality >= 100, we use lossless mode
-	if quality >= 100 {
+	if quality >= 100 || options.Lossless {
 		buf, _, err = img.ExportJxl(&vips.JxlExportParams{
-			Effort:   1,
+			Effort:   options.Effort,
 			Tier:     4,
 			Lossless: true,
 			Distance: 1.0,
 		})
 	} else {
 		buf, _, err = img.ExportJxl(&vips.JxlExportParams{
-			Effort:   1,
+			Effort:   options.Effort,
 			Tier:     4,
 			Quality:  quality,
 			Lossless: false,
@@ -190,7 +258,7 @@ func jxlEncoder(img *vips.ImageRef, rawPath string, optimizedPath string) error
 		return err
 	}
 
-	if err := os.WriteFile(optimizedPath, buf, 0600); err != nil {
+	if err := helper.WriteFileAtomic(optimizedPath, buf, 0600); err != nil {
 		log.Error(err)
 		return err
 	}
@@ -199,21 +267,24 @@ func jxlEncoder(img *vips.ImageRef, rawPath string, optimizedPath string) error
 	return nil
 }
 
-func avifEncoder(img *vips.ImageRef, rawPath string, optimizedPath string) error {
+func avifEncoder(img *vips.ImageRef, rawPath string, optimizedPath string, extraParams config.ExtraParams) error {
 	var (
 		buf     []byte
-		quality = config.Config.Quality
+		options = config.Config.AvifOptions
+		quality = encodeQuality(extraParams, options)
 		err     error
 	)
 
 	// If quality >= 100, we use lossless mode
-	if quality >= 100 {
+	if quality >= 100 || options.Lossless {
 		buf, _, err = img.ExportAvif(&vips.AvifExportParams{
+			Effort:        options.Effort,
 			Lossless:      true,
 			StripMetadata: config.Config.StripMetadata,
 		})
 	} else {
 		buf, _, err = img.ExportAvif(&vips.AvifExportParams{
+			Effort:        options.Effort,
 			Quality:       quality,
 			Lossless:      false,
 			StripMetadata: config.Config.StripMetadata,
@@ -225,7 +296,7 @@ func avifEncoder(img *vips.ImageRef, rawPath string, optimizedPath string) error
 		return err
 	}
 
-	if err := os.WriteFile(optimizedPath, buf, 0600); err != nil {
+	if err := helper.WriteFileAtomic(optimizedPath, buf, 0600); err != nil {
 		log.Error(err)
 		return err
 	}
@@ -234,31 +305,34 @@ func avifEncoder(img *vips.ImageRef, rawPath string, optimizedPath string) error
 	return nil
 }
 
-func webpEncoder(img *vips.ImageRef, rawPath string, optimizedPath string) error {
+func webpEncoder(img *vips.ImageRef, rawPath string, optimizedPath string, extraParams config.ExtraParams) error {
 	var (
 		buf     []byte
-		quality = config.Config.Quality
+		options = config.Config.WebpOptions
+		quality = encodeQuality(extraParams, options)
 		err     error
 	)
 
 	// If quality >= 100, we use lossless mode
-	if quality >= 100 {
+	if quality >= 100 || options.Lossless {
 		// Lossless mode will not encounter problems as below, because in libvips as code below
 		// 	config.method = ExUtilGetInt(argv[++c], 0, &parse_error);
 		//   use_lossless_preset = 0;   // disable -z option
 		buf, _, err = img.ExportWebp(&vips.WebpExportParams{
-			Lossless:      true,
-			StripMetadata: config.Config.StripMetadata,
+			Lossless:        true,
+			ReductionEffort: options.Effort,
+			StripMetadata:   config.Config.StripMetadata,
 		})
 	} else {
-		// If some special images cannot encode with default ReductionEffort(0), then retry from 0 to 6
+		// If some special images cannot encode with configured ReductionEffort(default 0), then retry up to 6
 		// Example: https://github.com/webp-sh/webp_server_go/issues/234
 		ep := vips.WebpExportParams{
-			Quality:       quality,
-			Lossless:      false,
-			StripMetadata: config.Config.StripMetadata,
+			Quality:         quality,
+			Lossless:        false,
+			ReductionEffort: options.Effort,
+			StripMetadata:   config.Config.StripMetadata,
 		}
-		for i := range 7 {
+		for i := options.Effort; i < 7; i++ {
 			ep.ReductionEffort = i
 			buf, _, err = img.ExportWebp(&ep)
 			if err != nil && strings.Contains(err.Error(), "unable to encode") {
@@ -277,7 +351,7 @@ func webpEncoder(img *vips.ImageRef, rawPath string, optimizedPath string) error
 		return err
 	}
 
-	if err := os.WriteFile(optimizedPath, buf, 0600); err != nil {
+	if err := helper.WriteFileAtomic(optimizedPath, buf, 0600); err != nil {
 		log.Error(err)
 		return err
 	}
@@ -286,6 +360,38 @@ func webpEncoder(img *vips.ImageRef, rawPath string, optimizedPath string) error
 	return nil
 }
 
+// encodeQuality returns quality= extra param if set and enabled, otherwise QUALITY of the format or QUALITY in config
+func encodeQuality(extraParams config.ExtraParams, options config.FormatOptions) int {
+	if config.Config.EnableExtraParams && extraParams.Quality > 0 {
+		return extraParams.Quality
+	}
+	if options.Quality > 0 {
+		return options.Quality
+	}
+	return config.Config.Quality
+}
+
+// CheckEncoder encodes a tiny blank image to imageType, reporting whether libvips can actually encode it
+func CheckEncoder(imageType string) error {
+	img, err := vips.Black(8, 8)
+	if err != nil {
+		return err
+	}
+	defer img.Close()
+
+	switch imageType {
+	case "webp":
+		_, _, err = img.ExportWebp(vips.NewWebpExportParams())
+	case "avif":
+		_, _, err = img.ExportAvif(vips.NewAvifExportParams())
+	case "jxl":
+		_, _, err = img.ExportJxl(vips.NewJxlExportParams())
+	default:
+		err = fmt.Errorf("unknown image type %s", imageType)
+	}
+	return err
+}
+
 func convertLog(itype, rawPath string, optimizedPath string, quality int) {
 	oldf, err := os.Stat(rawPath)
 	if err != nil {
@@ -0,0 +1,27 @@
+package encoder
+
+import (
+	"testing"
+	"webp_server_go/config"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEncodeQuality(t *testing.T) {
+	config.Config.Quality = 80
+	config.Config.EnableExtraParams = true
+	defer func() {
+		config.Config.EnableExtraParams = false
+	}()
+
+	// QUALITY in config is used by default
+	assert.Equal(t, 80, encodeQuality(config.ExtraParams{}, config.FormatOptions{}))
+	// Per format QUALITY overrides QUALITY in config
+	assert.Equal(t, 60, encodeQuality(config.ExtraParams{}, config.FormatOptions{Quality: 60}))
+	// quality= extra param overrides both
+	assert.Equal(t, 40, encodeQuality(config.ExtraParams{Quality: 40}, config.FormatOptions{Quality: 60}))
+
+	// quality= extra param is ignored if extra params are disabled
+	config.Config.EnableExtraParams = false
+	assert.Equal(t, 60, encodeQuality(config.ExtraParams{Quality: 40}, config.FormatOptions{Quality: 60}))
+}
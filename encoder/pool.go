@@ -0,0 +1,70 @@
+package encoder
+
+import (
+	"errors"
+	"sync"
+	"webp_server_go/config"
+)
+
+// ErrOverloaded means the conversion queue is full, see OVERLOAD_POLICY for how it's handled
+var ErrOverloaded = errors.New("conversion queue is full")
+
+// convertPool limits running encodes to CONVERT_WORKERS globally.
+// Requests wait in a FIFO queue of CONVERT_QUEUE_SIZE, so one needing several workers isn't starved by later ones
+// needing less. Prefetch only runs when no request is waiting.
+type convertPool struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	running int    // workers in use
+	queued  int    // requests waiting for workers, prefetch excluded
+	next    uint64 // ticket given to the next queued request
+	serving uint64 // ticket of the request taking workers next
+}
+
+var pool = newConvertPool()
+
+func newConvertPool() *convertPool {
+	p := &convertPool{}
+	p.cond = sync.NewCond(&p.mu)
+	return p
+}
+
+// acquire blocks until n workers are free, returning the number of workers taken, which is capped at CONVERT_WORKERS.
+// Callers must not run more encodes at once than workers taken, see runJobs.
+// For requests it returns ErrOverloaded instead if the queue is full and OVERLOAD_POLICY isn't wait.
+func (p *convertPool) acquire(n int, prefetch bool) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	workers := max(config.Config.ConvertWorkers, 1)
+	n = min(n, workers)
+	if prefetch {
+		for p.running+n > workers || p.queued > 0 {
+			p.cond.Wait()
+		}
+	} else {
+		if p.running+n > workers && p.queued >= config.Config.ConvertQueueSize && config.Config.OverloadPolicy != "wait" {
+			return 0, ErrOverloaded
+		}
+		ticket := p.next
+		p.next++
+		p.queued++
+		for p.serving != ticket || p.running+n > workers {
+			p.cond.Wait()
+		}
+		p.serving++
+		p.queued--
+		// Next request, or prefetch if no other request is waiting, may run on workers left
+		p.cond.Broadcast()
+	}
+	p.running += n
+	return n, nil
+}
+
+// release returns n workers taken by acquire
+func (p *convertPool) release(n int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.running -= n
+	p.cond.Broadcast()
+}
@@ -0,0 +1,128 @@
+package encoder
+
+import (
+	"sync"
+	"testing"
+	"time"
+	"webp_server_go/config"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConvertPool(t *testing.T) {
+	oldConfig := *config.Config
+	defer func() { *config.Config = oldConfig }()
+	config.Config.ConvertWorkers = 2
+	config.Config.ConvertQueueSize = 1
+	config.Config.OverloadPolicy = "reject"
+	p := newConvertPool()
+
+	workers, err := p.acquire(2, false)
+	assert.NoError(t, err)
+
+	acquired := make(chan string, 2)
+	go func() {
+		n, _ := p.acquire(1, true)
+		acquired <- "prefetch"
+		p.release(n)
+	}()
+	go func() {
+		n, _ := p.acquire(1, false)
+		acquired <- "request"
+		time.Sleep(50 * time.Millisecond)
+		p.release(n)
+	}()
+	waitQueued(t, p, 1)
+
+	// Queue is full
+	_, err = p.acquire(1, false)
+	assert.ErrorIs(t, err, ErrOverloaded)
+
+	config.Config.OverloadPolicy = "wait"
+	go func() {
+		n, _ := p.acquire(1, false)
+		acquired <- "waited"
+		p.release(n)
+	}()
+
+	waitQueued(t, p, 2)
+
+	// Requests go before prefetch once workers are released
+	p.release(workers)
+	assert.ElementsMatch(t, []string{"request", "waited"}, []string{<-acquired, <-acquired})
+	assert.Equal(t, "prefetch", <-acquired)
+}
+
+func TestConvertPoolFIFO(t *testing.T) {
+	oldConfig := *config.Config
+	defer func() { *config.Config = oldConfig }()
+	config.Config.ConvertWorkers = 2
+	config.Config.OverloadPolicy = "wait"
+	p := newConvertPool()
+
+	held, err := p.acquire(1, false)
+	assert.NoError(t, err)
+	acquired := make(chan string, 2)
+	go func() {
+		n, _ := p.acquire(2, false)
+		acquired <- "large"
+		time.Sleep(50 * time.Millisecond)
+		p.release(n)
+	}()
+	waitQueued(t, p, 1)
+	go func() {
+		n, _ := p.acquire(1, false)
+		acquired <- "small"
+		p.release(n)
+	}()
+	waitQueued(t, p, 2)
+
+	// A worker is free, but the small request queued later doesn't take it before the large one
+	select {
+	case name := <-acquired:
+		t.Fatalf("%s request took workers out of order", name)
+	case <-time.After(50 * time.Millisecond):
+	}
+	p.release(held)
+	assert.Equal(t, "large", <-acquired)
+	assert.Equal(t, "small", <-acquired)
+}
+
+func TestConvertPoolBoundsEncodes(t *testing.T) {
+	oldConfig := *config.Config
+	defer func() { *config.Config = oldConfig }()
+	config.Config.OverloadPolicy = "wait"
+	jobs := []convertJob{{"avif", "a.avif"}, {"webp", "a.webp"}, {"jxl", "a.jxl"}}
+
+	for _, convertWorkers := range []int{1, 2, 4} {
+		config.Config.ConvertWorkers = convertWorkers
+		p := newConvertPool()
+		var mu sync.Mutex
+		var running, peak, done int
+		workers, err := p.acquire(len(jobs), false)
+		assert.NoError(t, err)
+		runJobs(jobs, workers, func(convertJob) {
+			mu.Lock()
+			running++
+			peak = max(peak, running)
+			mu.Unlock()
+			time.Sleep(20 * time.Millisecond)
+			mu.Lock()
+			running--
+			done++
+			mu.Unlock()
+		})
+		p.release(workers)
+		assert.Equal(t, len(jobs), done)
+		assert.Equal(t, min(convertWorkers, len(jobs)), peak, "CONVERT_WORKERS=%d", convertWorkers)
+	}
+}
+
+func waitQueued(t *testing.T, p *convertPool, queued int) {
+	t.Helper()
+	assert.Eventually(t, func() bool {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		return p.queued == queued
+	}, time.Second, 10*time.Millisecond)
+}
@@ -1,6 +1,7 @@
 package encoder
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"path"
@@ -13,7 +14,8 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
-func PrefetchImages() {
+// PrefetchImages converts all images in IMG_PATH, no more conversions are started once ctx is done
+func PrefetchImages(ctx context.Context) {
 	// maximum ongoing prefetch is depending on your core of CPU
 	var sTime = time.Now()
 	log.Infof("Prefetching using %d cores", config.Jobs)
@@ -27,6 +29,9 @@ func PrefetchImages() {
 	var bar = progressbar.Default(all, "Prefetching...")
 	err := filepath.WalkDir(config.Config.ImgPath,
 		func(picAbsPath string, d os.DirEntry, err error) error {
+			if ctx.Err() != nil {
+				return filepath.SkipAll
+			}
 			if err != nil {
 				return err
 			}
@@ -74,6 +79,10 @@ func PrefetchImages() {
 	if err != nil {
 		log.Errorln(err)
 	}
+	if ctx.Err() != nil {
+		log.Info("Prefetch stopped")
+		return
+	}
 	elapsed := time.Since(sTime)
 	_, _ = fmt.Fprintf(os.Stdout, "Prefetch complete in %s\n\n", elapsed)
 
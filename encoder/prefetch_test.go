@@ -0,0 +1,30 @@
+package encoder
+
+import (
+	"context"
+	"os"
+	"testing"
+	"webp_server_go/config"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPrefetchStopsOnCancel(t *testing.T) {
+	oldConfig, oldJobs := *config.Config, config.Jobs
+	defer func() { *config.Config, config.Jobs = oldConfig, oldJobs }()
+	config.Config.ImgPath = "../pics"
+	config.Config.ExhaustPath = t.TempDir()
+	config.Config.MetadataPath = t.TempDir()
+	config.Jobs = 1
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	PrefetchImages(ctx)
+
+	entries, err := os.ReadDir(config.Config.ExhaustPath)
+	assert.NoError(t, err)
+	assert.Empty(t, entries)
+	entries, err = os.ReadDir(config.Config.MetadataPath)
+	assert.NoError(t, err)
+	assert.Empty(t, entries)
+}
@@ -2,10 +2,14 @@ package encoder
 
 import (
 	"errors"
+	"math"
 	"os"
 	"path"
 	"slices"
+	"strconv"
+	"strings"
 	"webp_server_go/config"
+	"webp_server_go/helper"
 
 	"github.com/davidbyttow/govips/v2/vips"
 	log "github.com/sirupsen/logrus"
@@ -17,6 +21,11 @@ func resizeImage(img *vips.ImageRef, extraParams config.ExtraParams) error {
 
 	imgHeightWidthRatio := float32(imageHeight) / float32(imageWidth)
 
+	// dpr shouldn't upscale, cap width and height at source size while keeping the requested ratio
+	if extraParams.Dpr > 1 {
+		extraParams.Width, extraParams.Height = capDimensions(extraParams.Width, extraParams.Height, imageWidth, imageHeight)
+	}
+
 	// Here we have width, height and max_width, max_height
 	// Both pairs cannot be used at the same time
 
@@ -25,7 +34,8 @@ func resizeImage(img *vips.ImageRef, extraParams config.ExtraParams) error {
 	// while smaller images are untouched
 
 	// If width or max is set and larger than original image, don't resize
-	if extraParams.Width > imageWidth || extraParams.Height > imageHeight {
+	// contain, fill, inside and outside are exceptions, fitImage handles sources smaller than the box
+	if (extraParams.Width > imageWidth || extraParams.Height > imageHeight) && !fitsAnySize(extraParams) {
 		return nil
 	}
 
@@ -68,27 +78,7 @@ func resizeImage(img *vips.ImageRef, extraParams config.ExtraParams) error {
 	}
 
 	if extraParams.Width > 0 && extraParams.Height > 0 {
-		var cropInteresting vips.Interesting
-		switch config.Config.ExtraParamsCropInteresting {
-		case "InterestingNone":
-			cropInteresting = vips.InterestingNone
-		case "InterestingCentre":
-			cropInteresting = vips.InterestingCentre
-		case "InterestingEntropy":
-			cropInteresting = vips.InterestingEntropy
-		case "InterestingAttention":
-			cropInteresting = vips.InterestingAttention
-		case "InterestingLow":
-			cropInteresting = vips.InterestingLow
-		case "InterestingHigh":
-			cropInteresting = vips.InterestingHigh
-		case "InterestingAll":
-			cropInteresting = vips.InterestingAll
-		default:
-			cropInteresting = vips.InterestingAttention
-		}
-
-		err := img.Thumbnail(extraParams.Width, extraParams.Height, cropInteresting)
+		err := fitImage(img, extraParams)
 		if err != nil {
 			return err
 		}
@@ -108,11 +98,177 @@ func resizeImage(img *vips.ImageRef, extraParams config.ExtraParams) error {
 	return nil
 }
 
-func ResizeItself(raw, dest string, extraParams config.ExtraParams) {
+// capDimensions scales width and height down by the same factor so that neither exceeds the source, 0 stays unset
+func capDimensions(width, height, imageWidth, imageHeight int) (int, int) {
+	scale := 1.0
+	if width > imageWidth {
+		scale = float64(imageWidth) / float64(width)
+	}
+	if height > imageHeight {
+		scale = min(scale, float64(imageHeight)/float64(height))
+	}
+	if scale == 1 {
+		return width, height
+	}
+	return int(math.Round(float64(width) * scale)), int(math.Round(float64(height) * scale))
+}
+
+// fitsAnySize reports whether both width and height are set with a fit that fitImage applies to sources of any size
+func fitsAnySize(extraParams config.ExtraParams) bool {
+	switch extraParams.Fit {
+	case "contain", "fill", "inside", "outside":
+		return extraParams.Width > 0 && extraParams.Height > 0
+	}
+	return false
+}
+
+// fitImage resizes img into Width x Height according to Fit
+// cover: scale to fill the box and crop the overflow around Gravity, this is the default
+// contain: scale to fit inside the box and pad the rest with Background
+// fill: stretch to the box, ignoring aspect ratio
+// inside: scale to fit inside the box, output may be smaller than the box
+// outside: scale to cover the box, output may be larger than the box
+// inside and outside never upscale, their scale factor is capped at 1
+func fitImage(img *vips.ImageRef, extraParams config.ExtraParams) error {
+	width, height := extraParams.Width, extraParams.Height
+	switch extraParams.Fit {
+	case "contain":
+		err := img.ThumbnailWithSize(width, height, vips.InterestingNone, vips.SizeDown)
+		if err != nil {
+			return err
+		}
+		background := parseBackground(extraParams.Background)
+		if background.A < 255 && !img.HasAlpha() {
+			if err := img.AddAlpha(); err != nil {
+				return err
+			}
+		}
+		return img.EmbedBackgroundRGBA((width-img.Width())/2, (height-img.PageHeight())/2, width, height, background)
+	case "fill":
+		return img.ThumbnailWithSize(width, height, vips.InterestingNone, vips.SizeForce)
+	case "inside", "outside":
+		widthScale, heightScale := float64(width)/float64(img.Width()), float64(height)/float64(img.PageHeight())
+		scale := min(widthScale, heightScale)
+		if extraParams.Fit == "outside" {
+			scale = max(widthScale, heightScale)
+		}
+		if scale >= 1 {
+			return nil
+		}
+		return img.Thumbnail(int(math.Ceil(float64(img.Width())*scale)), int(math.Ceil(float64(img.PageHeight())*scale)), vips.InterestingNone)
+	}
+
+	switch extraParams.Gravity {
+	case "smart":
+		return img.Thumbnail(width, height, vips.InterestingAttention)
+	case "entropy":
+		return img.Thumbnail(width, height, vips.InterestingEntropy)
+	case "centre":
+		return img.Thumbnail(width, height, vips.InterestingCentre)
+	case "":
+		// Use EXTRA_PARAMS_CROP_INTERESTING below
+	default:
+		// Compass directions and focal point: scale to cover the box, then crop around the anchor
+		scale := max(float64(width)/float64(img.Width()), float64(height)/float64(img.PageHeight()))
+		err := img.Thumbnail(int(math.Ceil(float64(img.Width())*scale)), int(math.Ceil(float64(img.PageHeight())*scale)), vips.InterestingNone)
+		if err != nil {
+			return err
+		}
+		width, height = min(width, img.Width()), min(height, img.PageHeight())
+		left, top := cropOffset(extraParams, img.Width(), img.PageHeight(), width, height)
+		return img.ExtractArea(left, top, width, height)
+	}
+
+	var cropInteresting vips.Interesting
+	switch config.Config.ExtraParamsCropInteresting {
+	case "InterestingNone":
+		cropInteresting = vips.InterestingNone
+	case "InterestingCentre":
+		cropInteresting = vips.InterestingCentre
+	case "InterestingEntropy":
+		cropInteresting = vips.InterestingEntropy
+	case "InterestingAttention":
+		cropInteresting = vips.InterestingAttention
+	case "InterestingLow":
+		cropInteresting = vips.InterestingLow
+	case "InterestingHigh":
+		cropInteresting = vips.InterestingHigh
+	case "InterestingAll":
+		cropInteresting = vips.InterestingAll
+	default:
+		cropInteresting = vips.InterestingAttention
+	}
+	return img.Thumbnail(width, height, cropInteresting)
+}
+
+// cropOffset returns the top-left corner of a width x height crop from a imageWidth x imageHeight image,
+// anchored at compass direction or focal point in extraParams.Gravity
+func cropOffset(extraParams config.ExtraParams, imageWidth, imageHeight, width, height int) (int, int) {
+	// Position of the crop centre in 0-1, centre by default
+	x, y := 0.5, 0.5
+	switch {
+	case extraParams.Gravity == "focalpoint":
+		x, y = extraParams.FocalX, extraParams.FocalY
+	default:
+		if strings.Contains(extraParams.Gravity, "west") {
+			x = 0
+		} else if strings.Contains(extraParams.Gravity, "east") {
+			x = 1
+		}
+		if strings.HasPrefix(extraParams.Gravity, "north") {
+			y = 0
+		} else if strings.HasPrefix(extraParams.Gravity, "south") {
+			y = 1
+		}
+	}
+	left := int(math.Round(x*float64(imageWidth) - float64(width)/2))
+	top := int(math.Round(y*float64(imageHeight) - float64(height)/2))
+	return min(max(left, 0), imageWidth-width), min(max(top, 0), imageHeight-height)
+}
+
+// parseBackground parses normalized RRGGBB or RRGGBBAA background, default is opaque white
+func parseBackground(background string) *vips.ColorRGBA {
+	color := &vips.ColorRGBA{R: 255, G: 255, B: 255, A: 255}
+	value, err := strconv.ParseUint(background, 16, 32)
+	switch {
+	case err != nil:
+	case len(background) == 6:
+		color.R, color.G, color.B = uint8(value>>16), uint8(value>>8), uint8(value)
+	case len(background) == 8:
+		color.R, color.G, color.B, color.A = uint8(value>>24), uint8(value>>16), uint8(value>>8), uint8(value)
+	}
+	return color
+}
+
+// ResizeItself resizes raw in its own format to dest, ErrOverloaded is returned if the conversion pool is overloaded.
+// Concurrent requests for the same dest wait for a single resize.
+func ResizeItself(raw, dest string, extraParams config.ExtraParams) error {
+	conv, leader := joinConversion(dest)
+	if !leader {
+		return conv.wait()
+	}
+	err := resizeItself(raw, dest, extraParams)
+	finishConversion(dest, conv, err)
+	return err
+}
+
+func resizeItself(raw, dest string, extraParams config.ExtraParams) error {
+	defer helper.LockCacheFile(dest)()
+	if helper.ImageExists(dest) {
+		// Finished by another request before joining, or by another process
+		return nil
+	}
+	workers, err := pool.acquire(1, false)
+	if err != nil {
+		log.Warnf("conversion pool is overloaded, not resizing %s", raw)
+		return err
+	}
+	defer pool.release(workers)
+
 	log.Infof("Resize %s itself to %s", raw, dest)
 
 	// we need to create dir first
-	var err = os.MkdirAll(path.Dir(dest), 0755)
+	err = os.MkdirAll(path.Dir(dest), 0755)
 	if err != nil {
 		log.Error(err.Error())
 	}
@@ -123,15 +279,16 @@ func ResizeItself(raw, dest string, extraParams config.ExtraParams) {
 	})
 	if err != nil {
 		log.Warnf("Could not load %s: %s", raw, err)
-		return
+		return nil
 	}
 	_ = resizeImage(img, extraParams)
 	if config.Config.StripMetadata {
 		img.RemoveMetadata()
 	}
 	buf, _, _ := img.ExportNative()
-	_ = os.WriteFile(dest, buf, 0600)
+	_ = helper.WriteFileAtomic(dest, buf, 0600)
 	img.Close()
+	return nil
 }
 
 // Pre-process image(auto rotate, resize, etc.)
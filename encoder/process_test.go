@@ -99,3 +99,138 @@ func TestResizeImage(t *testing.T) {
 		}
 	}
 }
+
+func TestResizeImageFit(t *testing.T) {
+	// Source image is 400x200
+	testCases := []struct {
+		fit       string
+		width     int
+		height    int
+		expectedW int
+		expectedH int
+	}{
+		{fit: "", width: 100, height: 100, expectedW: 100, expectedH: 100},
+		{fit: "cover", width: 100, height: 100, expectedW: 100, expectedH: 100},
+		{fit: "contain", width: 100, height: 100, expectedW: 100, expectedH: 100},
+		// contain doesn't upscale, it pads the image to requested size
+		{fit: "contain", width: 800, height: 800, expectedW: 800, expectedH: 800},
+		{fit: "fill", width: 100, height: 300, expectedW: 100, expectedH: 300},
+		{fit: "inside", width: 100, height: 100, expectedW: 100, expectedH: 50},
+		{fit: "outside", width: 100, height: 100, expectedW: 200, expectedH: 100},
+		// Larger than original image, should not resize
+		{fit: "inside", width: 800, height: 800, expectedW: 400, expectedH: 200},
+		{fit: "outside", width: 800, height: 800, expectedW: 400, expectedH: 200},
+		// Only one side is larger than original image
+		{fit: "inside", width: 800, height: 100, expectedW: 200, expectedH: 100},
+		{fit: "inside", width: 100, height: 800, expectedW: 100, expectedH: 50},
+		{fit: "outside", width: 800, height: 100, expectedW: 400, expectedH: 200},
+		{fit: "outside", width: 300, height: 50, expectedW: 300, expectedH: 150},
+	}
+
+	for _, tc := range testCases {
+		img, _ := vips.Black(400, 200)
+		defer img.Close()
+		err := resizeImage(img, config.ExtraParams{Width: tc.width, Height: tc.height, Fit: tc.fit})
+		if err != nil {
+			t.Errorf("resizeImage with fit=%s failed with error: %v", tc.fit, err)
+		}
+
+		if img.Width() != tc.expectedW || img.Height() != tc.expectedH {
+			t.Errorf("resizeImage with fit=%s %dx%d failed: expected (%d, %d), got (%d, %d)",
+				tc.fit, tc.width, tc.height, tc.expectedW, tc.expectedH, img.Width(), img.Height())
+		}
+	}
+}
+
+func TestParseBackground(t *testing.T) {
+	testCases := []struct {
+		background string
+		expected   vips.ColorRGBA
+	}{
+		{background: "", expected: vips.ColorRGBA{R: 255, G: 255, B: 255, A: 255}},
+		{background: "000000", expected: vips.ColorRGBA{R: 0, G: 0, B: 0, A: 255}},
+		{background: "ff8000", expected: vips.ColorRGBA{R: 255, G: 128, B: 0, A: 255}},
+		{background: "ff800080", expected: vips.ColorRGBA{R: 255, G: 128, B: 0, A: 128}},
+	}
+
+	for _, tc := range testCases {
+		if actual := parseBackground(tc.background); *actual != tc.expected {
+			t.Errorf("parseBackground(%q): expected %v, got %v", tc.background, tc.expected, *actual)
+		}
+	}
+}
+
+func TestResizeImageGravity(t *testing.T) {
+	for _, gravity := range []string{"north", "southeast", "centre", "smart", "entropy", "focalpoint"} {
+		img, _ := vips.Black(400, 200)
+		defer img.Close()
+		err := resizeImage(img, config.ExtraParams{Width: 100, Height: 100, Gravity: gravity, FocalX: 0.9, FocalY: 0.1})
+		if err != nil {
+			t.Errorf("resizeImage with gravity=%s failed with error: %v", gravity, err)
+		}
+		if img.Width() != 100 || img.Height() != 100 {
+			t.Errorf("resizeImage with gravity=%s failed: expected (100, 100), got (%d, %d)", gravity, img.Width(), img.Height())
+		}
+	}
+}
+
+func TestCropOffset(t *testing.T) {
+	// Crop 100x100 from 200x100
+	testCases := []struct {
+		extraParams  config.ExtraParams
+		expectedLeft int
+		expectedTop  int
+	}{
+		{extraParams: config.ExtraParams{Gravity: "centre"}, expectedLeft: 50, expectedTop: 0},
+		{extraParams: config.ExtraParams{Gravity: "west"}, expectedLeft: 0, expectedTop: 0},
+		{extraParams: config.ExtraParams{Gravity: "east"}, expectedLeft: 100, expectedTop: 0},
+		{extraParams: config.ExtraParams{Gravity: "northeast"}, expectedLeft: 100, expectedTop: 0},
+		{extraParams: config.ExtraParams{Gravity: "south"}, expectedLeft: 50, expectedTop: 0},
+		{extraParams: config.ExtraParams{Gravity: "focalpoint", FocalX: 0.6, FocalY: 0.5}, expectedLeft: 70, expectedTop: 0},
+		// Focal point near the edge is clamped to the image
+		{extraParams: config.ExtraParams{Gravity: "focalpoint", FocalX: 0.95, FocalY: 0}, expectedLeft: 100, expectedTop: 0},
+	}
+
+	for _, tc := range testCases {
+		left, top := cropOffset(tc.extraParams, 200, 100, 100, 100)
+		if left != tc.expectedLeft || top != tc.expectedTop {
+			t.Errorf("cropOffset with gravity=%s: expected (%d, %d), got (%d, %d)",
+				tc.extraParams.Gravity, tc.expectedLeft, tc.expectedTop, left, top)
+		}
+	}
+
+	// Crop 100x100 from 100x300
+	left, top := cropOffset(config.ExtraParams{Gravity: "south"}, 100, 300, 100, 100)
+	if left != 0 || top != 200 {
+		t.Errorf("cropOffset with gravity=south: expected (0, 200), got (%d, %d)", left, top)
+	}
+}
+
+func TestResizeImageDpr(t *testing.T) {
+	// Source image is 400x200, dimensions are already multiplied by dpr
+	testCases := []struct {
+		extraParams config.ExtraParams
+		expectedW   int
+		expectedH   int
+	}{
+		{extraParams: config.ExtraParams{Width: 200, Dpr: 2}, expectedW: 200, expectedH: 100},
+		{extraParams: config.ExtraParams{Width: 600, Dpr: 3}, expectedW: 400, expectedH: 200},
+		{extraParams: config.ExtraParams{Width: 600, Height: 600, Dpr: 2}, expectedW: 200, expectedH: 200},
+		{extraParams: config.ExtraParams{Width: 800, Height: 200, Dpr: 2}, expectedW: 400, expectedH: 100},
+		// Without dpr, larger dimensions are not resized
+		{extraParams: config.ExtraParams{Width: 600, Height: 600}, expectedW: 400, expectedH: 200},
+	}
+
+	for _, tc := range testCases {
+		img, _ := vips.Black(400, 200)
+		defer img.Close()
+		err := resizeImage(img, tc.extraParams)
+		if err != nil {
+			t.Errorf("resizeImage failed with error: %v", err)
+		}
+		if img.Width() != tc.expectedW || img.Height() != tc.expectedH {
+			t.Errorf("resizeImage with %+v failed: expected (%d, %d), got (%d, %d)",
+				tc.extraParams, tc.expectedW, tc.expectedH, img.Width(), img.Height())
+		}
+	}
+}
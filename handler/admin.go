@@ -0,0 +1,148 @@
+package handler
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"webp_server_go/config"
+	"webp_server_go/helper"
+
+	"github.com/gofiber/fiber/v2"
+	log "github.com/sirupsen/logrus"
+)
+
+// purgeRequest is the body of POST /purge, one of URL and Prefix can be combined with Host to limit the scope
+type purgeRequest struct {
+	URL    string `json:"url"`    // exact remote URL, or local path matching all its variants
+	Prefix string `json:"prefix"` // prefix of remote URL, URL path or local path
+	Host   string `json:"host"`   // targetHostName subdir, e.g. local or www.example.com
+}
+
+// AdminAuth rejects requests without ADMIN_TOKEN as bearer token
+func AdminAuth(c *fiber.Ctx) error {
+	token, found := strings.CutPrefix(c.Get(fiber.HeaderAuthorization), "Bearer ")
+	if config.Config.AdminToken == "" || !found ||
+		subtle.ConstantTimeCompare([]byte(token), []byte(config.Config.AdminToken)) != 1 {
+		c.Status(http.StatusUnauthorized)
+		return c.JSON(fiber.Map{"error": "unauthorized"})
+	}
+	return c.Next()
+}
+
+// Purge removes exhaust, metadata and remote-raw files and remote etag cache of matching images
+func Purge(c *fiber.Ctx) error {
+	var req purgeRequest
+	if err := c.BodyParser(&req); err != nil {
+		c.Status(http.StatusBadRequest)
+		return c.JSON(fiber.Map{"error": "invalid body: " + err.Error()})
+	}
+	if req.Host != "" && !isValidSubdir(req.Host) {
+		c.Status(http.StatusBadRequest)
+		return c.JSON(fiber.Map{"error": "invalid host"})
+	}
+
+	var purged int
+	switch {
+	case req.URL != "" && req.Prefix != "":
+		c.Status(http.StatusBadRequest)
+		return c.JSON(fiber.Map{"error": "url and prefix can't be used together"})
+	case req.URL != "":
+		purged = purgeMatching(req.Host, func(metadata config.MetaFile) bool {
+			return metadata.Path == req.URL || localPath(metadata.Path) == req.URL
+		})
+	case req.Prefix != "":
+		purged = purgeMatching(req.Host, func(metadata config.MetaFile) bool {
+			return strings.HasPrefix(metadata.Path, req.Prefix) || strings.HasPrefix(localPath(metadata.Path), req.Prefix)
+		})
+	case req.Host != "":
+		purged = purgeHost(req.Host)
+	default:
+		c.Status(http.StatusBadRequest)
+		return c.JSON(fiber.Map{"error": "one of url, prefix or host is required"})
+	}
+
+	log.Infof("Purged %d images with url=%q prefix=%q host=%q", purged, req.URL, req.Prefix, req.Host)
+	return c.JSON(fiber.Map{"purged": purged})
+}
+
+// localPath returns the path part of metadata.Path, without query of local variants or scheme and host of remote URLs
+func localPath(p string) string {
+	parsed, err := url.Parse(p)
+	if err != nil {
+		return p
+	}
+	return parsed.Path
+}
+
+// isValidSubdir reports whether host can be used as a subdir of EXHAUST_PATH etc without escaping it
+func isValidSubdir(host string) bool {
+	return host != "." && host != ".." && !strings.ContainsAny(host, `/\`)
+}
+
+// subdirs returns host, or all subdirs in METADATA_PATH if host is empty
+func subdirs(host string) []string {
+	if host != "" {
+		return []string{host}
+	}
+	entries, err := os.ReadDir(config.Config.MetadataPath)
+	if err != nil {
+		log.Warnf("failed to list %s: %s", config.Config.MetadataPath, err)
+		return nil
+	}
+	var dirs []string
+	for _, entry := range entries {
+		if entry.IsDir() {
+			dirs = append(dirs, entry.Name())
+		}
+	}
+	return dirs
+}
+
+// purgeMatching purges images in host (or all hosts if empty) whose metadata matches, returning the number of images
+func purgeMatching(host string, match func(config.MetaFile) bool) int {
+	var purged int
+	for _, subdir := range subdirs(host) {
+		metadatas, err := helper.ListMetadata(subdir)
+		if err != nil {
+			log.Warnf("failed to list metadata of %s: %s", subdir, err)
+			continue
+		}
+		for _, metadata := range metadatas {
+			if match(metadata) {
+				purgeImage(metadata, subdir)
+				purged++
+			}
+		}
+	}
+	return purged
+}
+
+// purgeImage removes cache of a single image, variants in exhaust share its id as prefix
+func purgeImage(metadata config.MetaFile, subdir string) {
+	cleanProxyCache(path.Join(config.Config.ExhaustPath, subdir, metadata.Id))
+	if regexp.MustCompile(config.HttpRegexp).MatchString(metadata.Path) {
+		cleanProxyCache(path.Join(config.Config.RemoteRawPath, subdir, metadata.Id))
+		config.RemoteCache.Delete(subdir + ":" + helper.HashString(metadata.Path))
+	}
+	helper.DeleteMetadata(metadata.Path, subdir)
+}
+
+// purgeHost removes the whole host subdir, returning the number of images
+func purgeHost(host string) int {
+	metadatas, _ := helper.ListMetadata(host)
+	for _, dir := range []string{config.Config.ExhaustPath, config.Config.MetadataPath, config.Config.RemoteRawPath} {
+		if err := os.RemoveAll(path.Join(dir, host)); err != nil {
+			log.Warnf("failed to remove %s: %s", path.Join(dir, host), err)
+		}
+	}
+	for key := range config.RemoteCache.Items() {
+		if strings.HasPrefix(key, host+":") {
+			config.RemoteCache.Delete(key)
+		}
+	}
+	return len(metadatas)
+}
@@ -0,0 +1,140 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+	"webp_server_go/config"
+	"webp_server_go/helper"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/patrickmn/go-cache"
+	"github.com/stretchr/testify/assert"
+)
+
+func setupPurge(t *testing.T) *fiber.App {
+	t.Helper()
+	tmpDir := t.TempDir()
+	config.Config.ExhaustPath = path.Join(tmpDir, "exhaust")
+	config.Config.MetadataPath = path.Join(tmpDir, "metadata")
+	config.Config.RemoteRawPath = path.Join(tmpDir, "remote-raw")
+	config.Config.AdminToken = "t0ken"
+	config.RemoteCache = cache.New(cache.NoExpiration, 10*time.Minute)
+	t.Cleanup(func() {
+		config.Config.AdminToken = ""
+	})
+
+	images := []struct {
+		subdir string
+		path   string
+	}{
+		{config.LocalHostAlias, "/images/tsuki.jpg?width=&height=&max_width=&max_height="},
+		{config.LocalHostAlias, "/images/tsuki.jpg?width=200&height=&max_width=&max_height="},
+		{config.LocalHostAlias, "/blog/sora.png?width=&height=&max_width=&max_height="},
+		{"www.example.com", "https://www.example.com/images/tsuki.jpg"},
+		{"www.example.com", "https://www.example.com/blog/sora.png"},
+	}
+	for _, image := range images {
+		id := helper.HashString(image.path)
+		metadata, _ := json.Marshal(config.MetaFile{Id: id, Path: image.path})
+		writeFile(t, path.Join(config.Config.MetadataPath, image.subdir, id+".json"), metadata)
+		if image.subdir != config.LocalHostAlias {
+			writeFile(t, path.Join(config.Config.RemoteRawPath, image.subdir, id+path.Ext(image.path)), []byte("raw"))
+			config.RemoteCache.Set(image.subdir+":"+id, "etag", cache.DefaultExpiration)
+		}
+		writeFile(t, path.Join(config.Config.ExhaustPath, image.subdir, id+".0000000000000000.webp"), []byte("webp"))
+	}
+
+	app := fiber.New()
+	app.Use(AdminAuth)
+	app.Post("/purge", Purge)
+	return app
+}
+
+func writeFile(t *testing.T, p string, data []byte) {
+	t.Helper()
+	assert.NoError(t, os.MkdirAll(path.Dir(p), 0755))
+	assert.NoError(t, os.WriteFile(p, data, 0644))
+}
+
+func purge(t *testing.T, app *fiber.App, token string, body string) (int, map[string]any) {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, "/purge", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := app.Test(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var result map[string]any
+	_ = json.NewDecoder(resp.Body).Decode(&result)
+	return resp.StatusCode, result
+}
+
+func countFiles(dir string) int {
+	return int(helper.FileCount(dir))
+}
+
+func TestPurgeAuth(t *testing.T) {
+	app := setupPurge(t)
+
+	status, _ := purge(t, app, "wrong", `{"host": "local"}`)
+	assert.Equal(t, http.StatusUnauthorized, status)
+	assert.Equal(t, 3, countFiles(path.Join(config.Config.ExhaustPath, config.LocalHostAlias)))
+}
+
+func TestPurgeURL(t *testing.T) {
+	app := setupPurge(t)
+
+	// Local path purges all its variants
+	status, result := purge(t, app, "t0ken", `{"url": "/images/tsuki.jpg", "host": "local"}`)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, float64(2), result["purged"])
+	assert.Equal(t, 1, countFiles(path.Join(config.Config.ExhaustPath, config.LocalHostAlias)))
+	assert.Equal(t, 1, countFiles(path.Join(config.Config.MetadataPath, config.LocalHostAlias)))
+
+	status, result = purge(t, app, "t0ken", `{"url": "https://www.example.com/blog/sora.png"}`)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, float64(1), result["purged"])
+	assert.Equal(t, 1, countFiles(path.Join(config.Config.ExhaustPath, "www.example.com")))
+	assert.Equal(t, 1, countFiles(path.Join(config.Config.RemoteRawPath, "www.example.com")))
+	_, found := config.RemoteCache.Get("www.example.com:" + helper.HashString("https://www.example.com/blog/sora.png"))
+	assert.False(t, found)
+	_, found = config.RemoteCache.Get("www.example.com:" + helper.HashString("https://www.example.com/images/tsuki.jpg"))
+	assert.True(t, found)
+}
+
+func TestPurgePrefix(t *testing.T) {
+	app := setupPurge(t)
+
+	// Path prefix matches both local and remote images
+	status, result := purge(t, app, "t0ken", `{"prefix": "/images/"}`)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, float64(3), result["purged"])
+	assert.Equal(t, 1, countFiles(path.Join(config.Config.ExhaustPath, config.LocalHostAlias)))
+	assert.Equal(t, 1, countFiles(path.Join(config.Config.ExhaustPath, "www.example.com")))
+}
+
+func TestPurgeHost(t *testing.T) {
+	app := setupPurge(t)
+
+	status, result := purge(t, app, "t0ken", `{"host": "www.example.com"}`)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, float64(2), result["purged"])
+	assert.Equal(t, 0, countFiles(path.Join(config.Config.ExhaustPath, "www.example.com")))
+	assert.Equal(t, 0, countFiles(path.Join(config.Config.RemoteRawPath, "www.example.com")))
+	assert.Equal(t, 3, countFiles(path.Join(config.Config.ExhaustPath, config.LocalHostAlias)))
+	assert.Equal(t, 0, config.RemoteCache.ItemCount())
+
+	status, _ = purge(t, app, "t0ken", `{"host": ".."}`)
+	assert.Equal(t, http.StatusBadRequest, status)
+
+	status, _ = purge(t, app, "t0ken", `{}`)
+	assert.Equal(t, http.StatusBadRequest, status)
+}
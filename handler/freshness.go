@@ -0,0 +1,91 @@
+package handler
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"webp_server_go/config"
+
+	"github.com/patrickmn/go-cache"
+)
+
+// remoteFreshness is what an upstream response allows us to do with its cached copy, as in RFC 9111
+type remoteFreshness struct {
+	ttl            time.Duration // How long it's fresh, negative means the upstream didn't say
+	noStore        bool          // Must not be cached, "private" is included since all clients share our cache
+	mustRevalidate bool          // Must not be served once stale without revalidation
+}
+
+// parseFreshness reads Cache-Control, or Expires if there's no max-age, of upstream response header
+func parseFreshness(header http.Header, now time.Time) remoteFreshness {
+	freshness := remoteFreshness{ttl: -1}
+	maxAge, sMaxAge := -1, -1
+	for _, value := range header.Values("Cache-Control") {
+		for directive := range strings.SplitSeq(value, ",") {
+			name, argument, _ := strings.Cut(strings.TrimSpace(directive), "=")
+			argument = strings.Trim(argument, `"`)
+			switch strings.ToLower(name) {
+			case "no-store", "private":
+				freshness.noStore = true
+			case "no-cache":
+				// May be stored, but never served without revalidation
+				maxAge = 0
+				freshness.mustRevalidate = true
+			case "must-revalidate", "proxy-revalidate":
+				freshness.mustRevalidate = true
+			case "max-age":
+				if seconds, err := strconv.Atoi(argument); err == nil && maxAge != 0 {
+					maxAge = max(seconds, 0)
+				}
+			case "s-maxage":
+				// s-maxage also implies proxy-revalidate for shared caches
+				if seconds, err := strconv.Atoi(argument); err == nil {
+					sMaxAge = max(seconds, 0)
+					freshness.mustRevalidate = true
+				}
+			}
+		}
+	}
+
+	switch {
+	case sMaxAge >= 0:
+		freshness.ttl = time.Duration(sMaxAge) * time.Second
+	case maxAge >= 0:
+		freshness.ttl = time.Duration(maxAge) * time.Second
+	case header.Get("Expires") != "":
+		// Invalid Expires, e.g. "0", means already expired
+		freshness.ttl = 0
+		if expires, err := http.ParseTime(header.Get("Expires")); err == nil {
+			date, err := http.ParseTime(header.Get("Date"))
+			if err != nil {
+				date = now
+			}
+			freshness.ttl = max(expires.Sub(date), 0)
+		}
+	default:
+		return freshness
+	}
+	// Time the response already spent in caches between the upstream and us
+	if age, err := strconv.Atoi(header.Get("Age")); err == nil && age > 0 {
+		freshness.ttl = max(freshness.ttl-time.Duration(age)*time.Second, 0)
+	}
+	return freshness
+}
+
+// cacheTTL returns how long the response is used without revalidation, bounded by REMOTE_MIN_TTL and
+// REMOTE_MAX_TTL. CACHE_TTL applies if the upstream didn't say, 0 means it's revalidated on every request.
+func (f remoteFreshness) cacheTTL() time.Duration {
+	ttl := f.ttl
+	if ttl < 0 {
+		if config.Config.CacheTTL == 0 {
+			return cache.NoExpiration
+		}
+		return time.Duration(config.Config.CacheTTL) * time.Minute
+	}
+	ttl = max(ttl, time.Duration(config.Config.RemoteMinTTL)*time.Second)
+	if config.Config.RemoteMaxTTL > 0 {
+		ttl = min(ttl, time.Duration(config.Config.RemoteMaxTTL)*time.Second)
+	}
+	return ttl
+}
@@ -0,0 +1,56 @@
+package handler
+
+import (
+	"net/http"
+	"testing"
+	"time"
+	"webp_server_go/config"
+
+	"github.com/patrickmn/go-cache"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseFreshness(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	cases := []struct {
+		header   http.Header
+		expected remoteFreshness
+	}{
+		{http.Header{}, remoteFreshness{ttl: -1}},
+		{http.Header{"Cache-Control": {"public, max-age=600"}}, remoteFreshness{ttl: 10 * time.Minute}},
+		{http.Header{"Cache-Control": {"max-age=600, s-maxage=60"}}, remoteFreshness{ttl: time.Minute, mustRevalidate: true}},
+		{http.Header{"Cache-Control": {"max-age=600", "must-revalidate"}}, remoteFreshness{ttl: 10 * time.Minute, mustRevalidate: true}},
+		{http.Header{"Cache-Control": {`no-cache, max-age="600"`}}, remoteFreshness{ttl: 0, mustRevalidate: true}},
+		{http.Header{"Cache-Control": {"no-store"}}, remoteFreshness{ttl: -1, noStore: true}},
+		{http.Header{"Cache-Control": {"private, max-age=600"}}, remoteFreshness{ttl: 10 * time.Minute, noStore: true}},
+		{http.Header{"Cache-Control": {"max-age=600"}, "Age": {"100"}}, remoteFreshness{ttl: 500 * time.Second}},
+		{http.Header{"Cache-Control": {"max-age=600"}, "Expires": {"Mon, 01 Jan 2024 01:00:00 GMT"}}, remoteFreshness{ttl: 10 * time.Minute}},
+		{http.Header{"Expires": {"Mon, 01 Jan 2024 01:00:00 GMT"}}, remoteFreshness{ttl: time.Hour}},
+		{http.Header{"Expires": {"Mon, 01 Jan 2024 01:00:00 GMT"}, "Date": {"Mon, 01 Jan 2024 00:30:00 GMT"}}, remoteFreshness{ttl: 30 * time.Minute}},
+		{http.Header{"Expires": {"Sun, 31 Dec 2023 00:00:00 GMT"}}, remoteFreshness{ttl: 0}},
+		{http.Header{"Expires": {"0"}}, remoteFreshness{ttl: 0}},
+	}
+	for _, c := range cases {
+		assert.Equal(t, c.expected, parseFreshness(c.header, now), c.header)
+	}
+}
+
+func TestCacheTTL(t *testing.T) {
+	oldConfig := *config.Config
+	defer func() { *config.Config = oldConfig }()
+	config.Config.CacheTTL = 60
+	config.Config.RemoteMinTTL = 60
+	config.Config.RemoteMaxTTL = 3600
+
+	assert.Equal(t, time.Hour, remoteFreshness{ttl: -1}.cacheTTL())
+	assert.Equal(t, time.Minute, remoteFreshness{ttl: 0}.cacheTTL())
+	assert.Equal(t, 10*time.Minute, remoteFreshness{ttl: 10 * time.Minute}.cacheTTL())
+	assert.Equal(t, time.Hour, remoteFreshness{ttl: 24 * time.Hour}.cacheTTL())
+
+	config.Config.CacheTTL = 0
+	config.Config.RemoteMinTTL = 0
+	config.Config.RemoteMaxTTL = 0
+	assert.Equal(t, cache.NoExpiration, remoteFreshness{ttl: -1}.cacheTTL())
+	assert.Equal(t, time.Duration(0), remoteFreshness{ttl: 0}.cacheTTL())
+	assert.Equal(t, 24*time.Hour, remoteFreshness{ttl: 24 * time.Hour}.cacheTTL())
+}
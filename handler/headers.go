@@ -0,0 +1,121 @@
+package handler
+
+import (
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+	"webp_server_go/config"
+	"webp_server_go/helper"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// cacheControl returns Cache-Control of images in state, CACHE_CONTROL in IMG_MAP_OPTIONS of the matching IMG_MAP entry
+// (or IMG_PATH_OPTIONS) takes precedence
+func cacheControl(state requestState) string {
+	if options := state.options(); options.CacheControl != "" {
+		return options.CacheControl
+	}
+	return config.Config.CacheControl
+}
+
+// variantETag returns a strong ETag of filename served for metadata.
+// It changes with the source file(Checksum), extra params(Id), encoder settings and output format(file name).
+func variantETag(metadata config.MetaFile, filename string) string {
+	return `"` + helper.HashString(metadata.Checksum+metadata.Id+path.Base(filename)) + `"`
+}
+
+// etagMatches reports whether If-None-Match header value matches etag, using weak comparison as in RFC 9110
+func etagMatches(ifNoneMatch string, etag string) bool {
+	for candidate := range strings.SplitSeq(ifNoneMatch, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// setCacheHeaders sets Vary, Cache-Control and ETag of filename served for metadata, returning the ETag.
+// negotiated means filename was chosen from request headers, so caches have to vary on them.
+func setCacheHeaders(c *fiber.Ctx, state requestState, metadata config.MetaFile, filename string, negotiated bool) string {
+	if negotiated {
+		// Output format depends on Accept, and on User-Agent for clients that don't announce their support
+		c.Vary(fiber.HeaderAccept, fiber.HeaderUserAgent)
+	}
+	if value := cacheControl(state); value != "" {
+		c.Set(fiber.HeaderCacheControl, value)
+	}
+	etag := variantETag(metadata, filename)
+	c.Set(fiber.HeaderETag, etag)
+	return etag
+}
+
+// sendImage sends filename with caching headers, or 304 without reading it if the client already has it.
+func sendImage(c *fiber.Ctx, state requestState, metadata config.MetaFile, filename string, negotiated bool) error {
+	etag := setCacheHeaders(c, state, metadata, filename, negotiated)
+	if etagMatches(c.Get(fiber.HeaderIfNoneMatch), etag) {
+		return c.SendStatus(http.StatusNotModified)
+	}
+
+	c.Set(fiber.HeaderContentType, helper.GetFileContentType(filename))
+	return c.SendFile(filename)
+}
+
+// sendFile sends non-image filename as is, with an ETag of its content, or 304 if the client already has it
+func sendFile(c *fiber.Ctx, filename string) error {
+	etag := `"` + helper.HashFile(filename) + `"`
+	c.Set(fiber.HeaderETag, etag)
+	if etagMatches(c.Get(fiber.HeaderIfNoneMatch), etag) {
+		return c.SendStatus(http.StatusNotModified)
+	}
+	return c.SendFile(filename)
+}
+
+// isHeadOrConditional reports whether the request can be answered with headers only
+func isHeadOrConditional(c *fiber.Ctx) bool {
+	return c.Method() == fiber.MethodHead || c.Get(fiber.HeaderIfNoneMatch) != "" || c.Get(fiber.HeaderIfModifiedSince) != ""
+}
+
+// notModified evaluates If-None-Match, or If-Modified-Since if there's no If-None-Match, as in RFC 9110
+func notModified(c *fiber.Ctx, etag string, modTime time.Time) bool {
+	if ifNoneMatch := c.Get(fiber.HeaderIfNoneMatch); ifNoneMatch != "" {
+		return etagMatches(ifNoneMatch, etag)
+	}
+	since, err := http.ParseTime(c.Get(fiber.HeaderIfModifiedSince))
+	return err == nil && !modTime.Truncate(time.Second).After(since)
+}
+
+// sendCachedHeaders answers HEAD and conditional requests for cached filename from its stat alone.
+// It returns false if the request has to go through the full path, e.g. the source is newer than filename
+// or a conditional GET doesn't match.
+func sendCachedHeaders(c *fiber.Ctx, state requestState, metadata config.MetaFile, rawImageAbs string, filename string, negotiated bool) (bool, error) {
+	stat, err := os.Stat(filename)
+	if err != nil {
+		return false, nil
+	}
+	// Local sources are only hashed in the full path, a source modified after filename was written is considered changed
+	if !state.isRemote() {
+		source, err := os.Stat(rawImageAbs)
+		if err != nil || source.ModTime().After(stat.ModTime()) {
+			return false, nil
+		}
+	}
+
+	etag := setCacheHeaders(c, state, metadata, filename, negotiated)
+	c.Set(fiber.HeaderLastModified, stat.ModTime().UTC().Format(http.TimeFormat))
+	if notModified(c, etag, stat.ModTime()) {
+		return true, c.SendStatus(http.StatusNotModified)
+	}
+	if c.Method() != fiber.MethodHead {
+		return false, nil
+	}
+
+	c.Set(fiber.HeaderContentType, helper.GetFileContentType(filename))
+	c.Set("X-Compression-Rate", helper.GetCompressionRate(rawImageAbs, filename))
+	c.Response().Header.SetContentLength(int(stat.Size()))
+	c.Response().SkipBody = true
+	return true, nil
+}
@@ -0,0 +1,47 @@
+package handler
+
+import (
+	"testing"
+	"webp_server_go/config"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCacheControl(t *testing.T) {
+	config.Config.CacheControl = "public, max-age=3600"
+	config.Config.ImageMapOptions = map[string]config.MapOptions{
+		"/avatars":               {CacheControl: "no-cache"},
+		"http://cdn.example.com": {CacheControl: "public, max-age=31536000, immutable"},
+		"/blog":                  {},
+	}
+	defer func() {
+		config.Config.CacheControl = ""
+		config.Config.ImageMapOptions = map[string]config.MapOptions{}
+	}()
+
+	assert.Equal(t, "public, max-age=3600", cacheControl(requestState{}))
+	assert.Equal(t, "no-cache", cacheControl(requestState{mapKey: "/avatars"}))
+	assert.Equal(t, "public, max-age=31536000, immutable", cacheControl(requestState{mapKey: "http://cdn.example.com"}))
+	assert.Equal(t, "public, max-age=3600", cacheControl(requestState{mapKey: "/blog"}))
+}
+
+func TestVariantETag(t *testing.T) {
+	metadata := config.MetaFile{Id: "8d8576343c4cb816", Checksum: "bd0da6ac8e5d5f5e"}
+	webp := variantETag(metadata, "exhaust/local/8d8576343c4cb816.0000000000000000.webp")
+	avif := variantETag(metadata, "exhaust/local/8d8576343c4cb816.0000000000000000.avif")
+
+	assert.Regexp(t, `^"[0-9a-f]+"$`, webp)
+	assert.NotEqual(t, webp, avif)
+	assert.Equal(t, webp, variantETag(metadata, "exhaust/local/8d8576343c4cb816.0000000000000000.webp"))
+
+	metadata.Checksum = "0000000000000000"
+	assert.NotEqual(t, webp, variantETag(metadata, "exhaust/local/8d8576343c4cb816.0000000000000000.webp"))
+}
+
+func TestEtagMatches(t *testing.T) {
+	assert.True(t, etagMatches(`"abc"`, `"abc"`))
+	assert.True(t, etagMatches(`"xyz", W/"abc"`, `"abc"`))
+	assert.True(t, etagMatches(`*`, `"abc"`))
+	assert.False(t, etagMatches(``, `"abc"`))
+	assert.False(t, etagMatches(`"abcd"`, `"abc"`))
+}
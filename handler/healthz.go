@@ -1,9 +1,131 @@
 package handler
 
 import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+	"webp_server_go/config"
+	"webp_server_go/encoder"
+
 	"github.com/gofiber/fiber/v2"
 )
 
+// readyCheck is the result of a single dependency check of /readyz
+type readyCheck struct {
+	Name  string `json:"name"`
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
 func Healthz(c *fiber.Ctx) error {
 	return c.SendString("WebP Server Go up and running!🥳")
 }
+
+// readyTTL is how long checks of /readyz are reused, so frequent probes don't encode and write files each time
+const readyTTL = 5 * time.Second
+
+// readyResult is the last result of readyChecks, concurrent probes wait for a single run instead of checking in parallel
+var readyResult struct {
+	sync.Mutex
+	checks  []readyCheck
+	checked time.Time
+}
+
+// Readyz checks cache paths are writable, enabled formats can be encoded and optionally remote IMG_PATH is reachable.
+// It returns 503 if any check fails, so traffic is held until the server is really usable.
+// Results are cached for readyTTL.
+func Readyz(c *fiber.Ctx) error {
+	readyResult.Lock()
+	if time.Since(readyResult.checked) >= readyTTL {
+		readyResult.checks = readyChecks()
+		readyResult.checked = time.Now()
+	}
+	checks := readyResult.checks
+	readyResult.Unlock()
+
+	ready := true
+	for _, check := range checks {
+		ready = ready && check.OK
+	}
+	if !ready {
+		c.Status(http.StatusServiceUnavailable)
+	}
+	return c.JSON(fiber.Map{"ready": ready, "checks": checks})
+}
+
+// readyChecks runs all checks of /readyz
+func readyChecks() []readyCheck {
+	var checks []readyCheck
+	for _, dir := range []struct {
+		name string
+		path string
+	}{
+		{"exhaust_path", config.Config.ExhaustPath},
+		{"metadata_path", config.Config.MetadataPath},
+		{"remote_raw_path", config.Config.RemoteRawPath},
+	} {
+		checks = append(checks, newReadyCheck(dir.name, checkWritable(dir.path)))
+	}
+	for _, format := range []struct {
+		name    string
+		enabled bool
+	}{
+		{"webp", config.Config.EnableWebP},
+		{"avif", config.Config.EnableAVIF},
+		{"jxl", config.Config.EnableJXL},
+	} {
+		if format.enabled {
+			checks = append(checks, newReadyCheck("encode_"+format.name, encoder.CheckEncoder(format.name)))
+		}
+	}
+	if config.Config.ReadyCheckRemote && isRemoteTarget(config.Config.ImgPath) {
+		checks = append(checks, newReadyCheck("upstream", checkUpstream(config.Config.ImgPath)))
+	}
+	return checks
+}
+
+func newReadyCheck(name string, err error) readyCheck {
+	if err != nil {
+		return readyCheck{Name: name, OK: false, Error: err.Error()}
+	}
+	return readyCheck{Name: name, OK: true}
+}
+
+// checkWritable creates dir if needed and writes a temporary file in it
+func checkWritable(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(dir, ".readyz-*")
+	if err != nil {
+		return err
+	}
+	_ = f.Close()
+	return os.Remove(f.Name())
+}
+
+// readyUpstreamTimeout limits the upstream check, it shouldn't hold readiness probes for long
+const readyUpstreamTimeout = 5 * time.Second
+
+// checkUpstream sends HEAD to remote IMG_PATH, any response other than 5xx means it's reachable
+func checkUpstream(target string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), readyUpstreamTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, target, nil)
+	if err != nil {
+		return err
+	}
+	req.Header = upstreamHeader(config.Config.ImgPathOptions, nil)
+	resp, err := upstreamClient().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return fmt.Errorf("remote returned %s", resp.Status)
+	}
+	return nil
+}
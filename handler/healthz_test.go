@@ -0,0 +1,137 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+	"time"
+	"webp_server_go/config"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+type readyResponse struct {
+	Ready  bool         `json:"ready"`
+	Checks []readyCheck `json:"checks"`
+}
+
+func setupReadyz(t *testing.T) *fiber.App {
+	t.Helper()
+	tmpDir := t.TempDir()
+	oldConfig := *config.Config
+	config.Config.ExhaustPath = path.Join(tmpDir, "exhaust")
+	config.Config.MetadataPath = path.Join(tmpDir, "metadata")
+	config.Config.RemoteRawPath = path.Join(tmpDir, "remote-raw")
+	config.Config.EnableWebP = false
+	config.Config.EnableAVIF = false
+	config.Config.EnableJXL = false
+	expireReadyz()
+	t.Cleanup(func() {
+		*config.Config = oldConfig
+		expireReadyz()
+	})
+
+	app := fiber.New()
+	app.Get("/readyz", Readyz)
+	return app
+}
+
+// expireReadyz drops the cached result, so the next /readyz runs the checks again
+func expireReadyz() {
+	readyResult.Lock()
+	readyResult.checked = time.Time{}
+	readyResult.Unlock()
+}
+
+func getReadyz(t *testing.T, app *fiber.App) (int, readyResponse) {
+	t.Helper()
+	resp, err := app.Test(httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var result readyResponse
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&result))
+	return resp.StatusCode, result
+}
+
+func TestReadyzPaths(t *testing.T) {
+	app := setupReadyz(t)
+
+	status, result := getReadyz(t, app)
+	assert.Equal(t, http.StatusOK, status)
+	assert.True(t, result.Ready)
+	assert.Equal(t, []readyCheck{
+		{Name: "exhaust_path", OK: true},
+		{Name: "metadata_path", OK: true},
+		{Name: "remote_raw_path", OK: true},
+	}, result.Checks)
+
+	// A file in place of the directory can't be written into
+	config.Config.MetadataPath = path.Join(t.TempDir(), "metadata")
+	assert.NoError(t, os.WriteFile(config.Config.MetadataPath, []byte("not a dir"), 0644))
+	expireReadyz()
+	status, result = getReadyz(t, app)
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+	assert.False(t, result.Ready)
+	assert.False(t, result.Checks[1].OK)
+	assert.NotEmpty(t, result.Checks[1].Error)
+}
+
+func TestReadyzUpstream(t *testing.T) {
+	app := setupReadyz(t)
+	upstreamStatus := http.StatusNotFound
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(upstreamStatus)
+	}))
+	defer upstream.Close()
+	config.Config.ImgPath = upstream.URL
+
+	// Upstream is only checked when enabled
+	_, result := getReadyz(t, app)
+	assert.Len(t, result.Checks, 3)
+
+	config.Config.ReadyCheckRemote = true
+	expireReadyz()
+	status, result := getReadyz(t, app)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, readyCheck{Name: "upstream", OK: true}, result.Checks[3])
+
+	upstreamStatus = http.StatusBadGateway
+	expireReadyz()
+	status, result = getReadyz(t, app)
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+	assert.False(t, result.Checks[3].OK)
+}
+
+func TestReadyzCached(t *testing.T) {
+	app := setupReadyz(t)
+	requests := 0
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+	}))
+	defer upstream.Close()
+	config.Config.ImgPath = upstream.URL
+	config.Config.ReadyCheckRemote = true
+
+	status, _ := getReadyz(t, app)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, 1, requests)
+
+	// Probes within readyTTL get the last result without checking again
+	config.Config.MetadataPath = path.Join(t.TempDir(), "metadata")
+	assert.NoError(t, os.WriteFile(config.Config.MetadataPath, []byte("not a dir"), 0644))
+	status, result := getReadyz(t, app)
+	assert.Equal(t, http.StatusOK, status)
+	assert.True(t, result.Ready)
+	assert.Equal(t, 1, requests)
+
+	expireReadyz()
+	status, _ = getReadyz(t, app)
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+	assert.Equal(t, 2, requests)
+}
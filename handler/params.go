@@ -0,0 +1,123 @@
+package handler
+
+import (
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+	"webp_server_go/config"
+	"webp_server_go/signature"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// transformParams are the query params that change the output image, these need to be signed when SIGNATURE_SECRET is set
+var transformParams = []string{"width", "height", "max_width", "max_height", "quality", "format", "fit", "background", "gravity", "fp_x", "fp_y", "dpr"}
+
+// presetParams are the query params a preset can set, PRESETS_ONLY removes them from requests
+var presetParams = transformParams
+
+// applyPreset expands preset= in query into its params, raw params in query take precedence over the preset.
+// With PRESETS_ONLY, raw params are removed first. It returns false if the preset doesn't exist.
+func applyPreset(query url.Values) bool {
+	name := query.Get("preset")
+	query.Del("preset")
+	if config.Config.PresetsOnly {
+		for _, key := range presetParams {
+			query.Del(key)
+		}
+	}
+	if name == "" {
+		return true
+	}
+	preset, ok := config.Config.Presets[name]
+	if !ok {
+		return false
+	}
+	for key, values := range preset.Query() {
+		if !slices.Contains(presetParams, key) {
+			log.Warnf("Ignoring unknown param %s in preset %s", key, name)
+			continue
+		}
+		if !query.Has(key) {
+			query[key] = values
+		}
+	}
+	return true
+}
+
+func hasTransformParams(query url.Values) bool {
+	for _, key := range transformParams {
+		if query.Has(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkSignature verifies transformation params against SIGNATURE_SECRET.
+// It returns false if the request should be rejected, unsigned requests with SIGNATURE_FALLBACK=original
+// get their transformation params removed from query instead.
+func checkSignature(reqPath string, query url.Values) bool {
+	if config.Config.SignatureSecret == "" {
+		return true
+	}
+	if hasTransformParams(query) {
+		if err := signature.Verify(config.Config.SignatureSecret, reqPath, query, time.Now()); err != nil {
+			if config.Config.SignatureFallback != "original" {
+				log.Warnf("Rejecting %s: %s", reqPath, err)
+				return false
+			}
+			log.Debugf("Serving %s in original size: %s", reqPath, err)
+			for _, key := range transformParams {
+				query.Del(key)
+			}
+		}
+	}
+	// sig and expires don't change the output, drop them so they don't end up in cache keys or upstream URLs
+	query.Del(signature.SigParam)
+	query.Del(signature.ExpiresParam)
+	return true
+}
+
+// withoutParams returns a copy of query without keys
+func withoutParams(query url.Values, keys []string) url.Values {
+	result := url.Values{}
+	for key, values := range query {
+		if !slices.Contains(keys, key) {
+			result[key] = values
+		}
+	}
+	return result
+}
+
+// forcedFormatAbs returns the optimized path of the format= override, or "" if it's unset or not in CONVERT_TYPES
+func forcedFormatAbs(format string, avifAbs, webpAbs, jxlAbs string) string {
+	switch {
+	case format == "avif" && config.Config.EnableAVIF:
+		return avifAbs
+	case format == "webp" && config.Config.EnableWebP:
+		return webpAbs
+	case format == "jxl" && config.Config.EnableJXL:
+		return jxlAbs
+	}
+	return ""
+}
+
+// withRawQuery appends params of rawQuery that are still in query to reqPath.
+// Their order and escaping are kept as sent, so upstream URLs and cache keys don't change.
+func withRawQuery(reqPath string, rawQuery string, query url.Values) string {
+	var kept []string
+	for part := range strings.SplitSeq(rawQuery, "&") {
+		key, _, _ := strings.Cut(part, "=")
+		key, err := url.QueryUnescape(key)
+		if part == "" || err != nil || !query.Has(key) {
+			continue
+		}
+		kept = append(kept, part)
+	}
+	if len(kept) == 0 {
+		return reqPath
+	}
+	return reqPath + "?" + strings.Join(kept, "&")
+}
@@ -0,0 +1,57 @@
+package handler
+
+import (
+	"net/url"
+	"testing"
+	"webp_server_go/config"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestApplyPreset(t *testing.T) {
+	config.Config.Presets = map[string]config.Preset{
+		"thumb": {"width": float64(320), "height": float64(180), "fit": "cover", "quality": float64(70), "unknown": "x"},
+	}
+	defer func() {
+		config.Config.Presets = map[string]config.Preset{}
+		config.Config.PresetsOnly = false
+	}()
+
+	t.Run("preset is expanded", func(t *testing.T) {
+		query, _ := url.ParseQuery("preset=thumb&foo=bar")
+		assert.True(t, applyPreset(query))
+		assert.Equal(t, "fit=cover&foo=bar&height=180&quality=70&width=320", query.Encode())
+	})
+
+	t.Run("raw params take precedence", func(t *testing.T) {
+		query, _ := url.ParseQuery("preset=thumb&quality=90")
+		assert.True(t, applyPreset(query))
+		assert.Equal(t, "90", query.Get("quality"))
+	})
+
+	t.Run("unknown preset", func(t *testing.T) {
+		query, _ := url.ParseQuery("preset=banner")
+		assert.False(t, applyPreset(query))
+	})
+
+	t.Run("presets only", func(t *testing.T) {
+		config.Config.PresetsOnly = true
+		query, _ := url.ParseQuery("preset=thumb&quality=90&format=avif&foo=bar")
+		assert.True(t, applyPreset(query))
+		assert.Equal(t, "fit=cover&foo=bar&height=180&quality=70&width=320", query.Encode())
+
+		query, _ = url.ParseQuery("width=100&max_height=100&foo=bar")
+		assert.True(t, applyPreset(query))
+		assert.Equal(t, "foo=bar", query.Encode())
+	})
+}
+
+func TestWithRawQuery(t *testing.T) {
+	rawQuery := "z=1&a=b%2Fc&sig=abc&expires=123&width=100&empty"
+	query, _ := url.ParseQuery(rawQuery)
+	query.Del("sig")
+	query.Del("expires")
+	query.Del("width")
+	assert.Equal(t, "/tsuki.jpg?z=1&a=b%2Fc&empty", withRawQuery("/tsuki.jpg", rawQuery, query))
+	assert.Equal(t, "/tsuki.jpg", withRawQuery("/tsuki.jpg", "sig=abc", url.Values{}))
+}
@@ -2,17 +2,25 @@ package handler
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
 	"net/http"
 	"os"
 	"path"
 	"path/filepath"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 	"webp_server_go/config"
 	"webp_server_go/helper"
+	"webp_server_go/metrics"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/h2non/filetype"
-	"github.com/patrickmn/go-cache"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -31,128 +39,309 @@ func cleanProxyCache(cacheImagePath string) {
 	}
 }
 
-// Download file and return response header
-func downloadFile(filepath string, url string) http.Header {
-	resp, err := http.Get(url)
+// downloadFile GETs url into filepath with header, returning the response whose body is already closed.
+// 304 to a conditional request is returned as is, leaving filepath untouched.
+// Body is streamed to disk after its type is sniffed from the first bytes, and rejected beyond UPSTREAM MAX_BODY_SIZE.
+func downloadFile(filepath string, url string, header http.Header) (*http.Response, error) {
+	req, err := newUpstreamRequest(http.MethodGet, url, header)
 	if err != nil {
-		log.Errorln("Connection to remote error when downloadFile!")
-		return nil
+		return nil, err
+	}
+	start := time.Now()
+	resp, err := upstreamClient().Do(req)
+	if err != nil {
+		metrics.ObserveRemoteFetch(http.MethodGet, start, true)
+		return nil, err
 	}
 	defer resp.Body.Close()
+	metrics.ObserveRemoteFetch(http.MethodGet, start, resp.StatusCode != fiber.StatusOK && resp.StatusCode != fiber.StatusNotModified)
 
+	if resp.StatusCode == fiber.StatusNotModified {
+		return resp, nil
+	}
 	if resp.StatusCode != fiber.StatusOK {
-		log.Errorf("remote returned %s when fetching remote image", resp.Status)
-		return resp.Header
+		return nil, upstreamStatusError{StatusCode: resp.StatusCode, Status: resp.Status}
 	}
 
-	// Copy bytes here
-	bodyBytes := new(bytes.Buffer)
-	_, err = bodyBytes.ReadFrom(resp.Body)
-	if err != nil {
-		return nil
+	var body io.Reader = resp.Body
+	if limit := maxBodySize(); limit > 0 {
+		if resp.ContentLength > limit {
+			return nil, fmt.Errorf("remote file is %d bytes, larger than UPSTREAM MAX_BODY_SIZE", resp.ContentLength)
+		}
+		// One byte over the limit tells a body that is too large from one exactly at the limit
+		body = &bodyLimitReader{r: io.LimitReader(resp.Body, limit+1), limit: limit}
 	}
 
 	// Check if remote content-type is image using check by filetype instead of content-type returned by origin
-	kind, _ := filetype.Match(bodyBytes.Bytes())
+	head := make([]byte, 8192)
+	n, err := io.ReadFull(body, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, fmt.Errorf("read remote file: %w", err)
+	}
+	head = head[:n]
+	kind, _ := filetype.Match(head)
 	mime := kind.MIME.Value
 	if !strings.Contains(mime, "image") && !config.AllowAllExtensions {
-		log.Errorf("remote file %s is not image and AllowedTypes is not '*', remote content has MIME type of %s", url, mime)
-		return nil
+		return nil, fmt.Errorf("remote file is not image and AllowedTypes is not '*', remote content has MIME type of %s", mime)
 	}
 
 	_ = os.MkdirAll(path.Dir(filepath), 0755)
 
-	// Create Cache here as a lock, so we can prevent incomplete file from being read
-	// Key: filepath, Value: true
-	config.WriteLock.Set(filepath, true, -1)
-
-	err = os.WriteFile(filepath, bodyBytes.Bytes(), 0600)
+	// Renamed into place, so incomplete file is never read
+	err = helper.WriteReaderAtomic(filepath, io.MultiReader(bytes.NewReader(head), body), 0600)
 	if err != nil {
-		// not likely to happen
-		return nil
+		return nil, fmt.Errorf("save remote file: %w", err)
 	}
 
-	// Delete lock here
-	config.WriteLock.Delete(filepath)
+	return resp, nil
+}
+
+// bodyLimitReader fails reads once more than limit bytes arrived from r, so the partial file is never saved
+type bodyLimitReader struct {
+	r     io.Reader
+	limit int64
+	read  int64
+}
 
-	return resp.Header
+func (b *bodyLimitReader) Read(p []byte) (int, error) {
+	n, err := b.r.Read(p)
+	b.read += int64(n)
+	if b.read > b.limit {
+		return n, fmt.Errorf("remote file is larger than UPSTREAM MAX_BODY_SIZE of %d bytes", b.limit)
+	}
+	return n, err
 }
 
-func fetchRemoteImg(url string, subdir string) (metaContent config.MetaFile) {
-	// url is https://test.webp.sh/mypic/123.jpg?someother=200&somebugs=200
-	// How do we know if the remote img is changed? we're using hash(etag+length)
-	var etag string
+// remoteImage is a remote image fetched into REMOTE_RAW_PATH
+type remoteImage struct {
+	metadata config.MetaFile
+	rawPath  string // Empty if there's nothing to serve
+	noStore  bool   // The upstream doesn't allow caching it, files of metadata.Id have to be removed once served
+	stale    bool   // Served stale while revalidated in background, see remoteReplaced
+}
+
+// fetchRemote fetches the remote image of state for client c, bypassing the shared cache if client credentials are forwarded
+func fetchRemote(state requestState, c *fiber.Ctx) remoteImage {
+	options := state.options()
+	header := upstreamHeader(options, c)
+	if forwardsCredentials(options, c) {
+		return fetchPrivateImg(state.realRemoteAddr, state.targetHostName, header)
+	}
+	return fetchRemoteImg(state.realRemoteAddr, state.targetHostName, header)
+}
 
+// fetchRemoteImg fetches url into REMOTE_RAW_PATH/subdir, sending header to the upstream.
+// A fetched file is fresh for its upstream Cache-Control or Expires (CACHE_TTL if neither is sent), kept in RemoteCache
+// and its metadata, then revalidated by a conditional GET with validators in its metadata.
+// Converted images are removed when the checksum changes.
+// Within REMOTE_STALE_WHILE_REVALIDATE past freshness, the stale file is served at once and revalidated in background.
+func fetchRemoteImg(url string, subdir string, header http.Header) remoteImage {
+	// url is https://test.webp.sh/mypic/123.jpg?someother=200&somebugs=200
 	cacheKey := subdir + ":" + helper.HashString(url)
+	localRawImagePath := path.Join(config.Config.RemoteRawPath, subdir, helper.HashString(url)) + path.Ext(url)
 
-	if val, found := config.RemoteCache.Get(cacheKey); found {
-		if etagVal, ok := val.(string); ok {
+	if metadata, err := helper.LoadMetadata(url, subdir); err == nil && helper.ImageExists(localRawImagePath) {
+		if _, fresh := config.RemoteCache.Get(cacheKey); fresh {
+			log.Infof("Using cache for remote addr: %s", url)
+			return remoteImage{metadata: metadata, rawPath: localRawImagePath}
+		}
+		// Freshness saved in metadata outlives RemoteCache, e.g. across restarts or from another process
+		if freshFor := time.Until(time.Unix(metadata.FreshUntil, 0)); metadata.FreshUntil != 0 && freshFor > 0 {
 			log.Infof("Using cache for remote addr: %s", url)
-			etag = etagVal
-		} else {
-			config.RemoteCache.Delete(cacheKey)
+			config.RemoteCache.Set(cacheKey, metadata.Checksum, freshFor)
+			return remoteImage{metadata: metadata, rawPath: localRawImagePath}
+		}
+		if staleUsable(metadata, config.Config.RemoteStaleWhileRevalidate) {
+			log.Infof("Using stale cache for remote addr %s, revalidating in background", url)
+			refreshRemoteImg(url, subdir, header)
+			return remoteImage{metadata: metadata, rawPath: localRawImagePath, stale: true}
+		}
+	}
+	return revalidateRemoteImg(url, subdir, header)
+}
+
+// fetchPrivateImg fetches url for this request only, sending header with client credentials to the upstream.
+// The response may be specific to the client, so it's neither cached nor served from cache, and the file
+// under a unique id in REMOTE_RAW_PATH/subdir has to be removed once served like other no-store images.
+func fetchPrivateImg(url string, subdir string, header http.Header) remoteImage {
+	id, rawPath := uncachedRawPath(url, subdir)
+	log.Infof("Remote Addr is %s, fetching with client credentials...", url)
+	resp, err := downloadFile(rawPath, url, header)
+	if err != nil || resp.StatusCode != fiber.StatusOK {
+		log.Errorf("failed to fetch remote file %s: %v", url, err)
+		return remoteImage{}
+	}
+	metadata := helper.NewRemoteMetadata(url, rawPath, resp.Header.Get("ETag"), resp.Header.Get("Last-Modified"))
+	metadata.Id = id
+	return remoteImage{metadata: metadata, rawPath: rawPath, noStore: true}
+}
+
+// uncachedRawPath returns a unique id and REMOTE_RAW_PATH/subdir path to download url under
+func uncachedRawPath(url string, subdir string) (string, string) {
+	id := fmt.Sprintf("%016x", rand.Uint64())
+	return id, path.Join(config.Config.RemoteRawPath, subdir, id) + path.Ext(url)
+}
+
+// refreshing holds cache keys of remote images being revalidated in background, refreshes counts them
+var (
+	refreshing sync.Map
+	refreshes  atomic.Int32
+)
+
+// refreshRemoteImg revalidates url in background, unless it's already being revalidated
+func refreshRemoteImg(url string, subdir string, header http.Header) {
+	cacheKey := subdir + ":" + helper.HashString(url)
+	if _, running := refreshing.LoadOrStore(cacheKey, struct{}{}); running {
+		return
+	}
+	refreshes.Add(1)
+	go func() {
+		defer refreshes.Add(-1)
+		defer refreshing.Delete(cacheKey)
+		if image := revalidateRemoteImg(url, subdir, header); image.noStore {
+			removeUncached(image, subdir)
 		}
+	}()
+}
+
+// Refreshing returns the number of remote images being revalidated in background
+func Refreshing() int {
+	return int(refreshes.Load())
+}
+
+// remoteReplaced reports whether the fetched file of url in subdir no longer has checksum, returning its new metadata.
+// A background revalidation may replace a stale file while it's being encoded, and its removal of converted images
+// may run before the encode is done, leaving output of the old file under the new checksum.
+func remoteReplaced(url string, subdir string, checksum string) (config.MetaFile, bool) {
+	metadata, err := helper.LoadMetadata(url, subdir)
+	return metadata, err == nil && metadata.Checksum != checksum
+}
+
+// staleUsable reports whether the fetched file of metadata is stale for no more than grace seconds,
+// and the upstream allows serving it stale. Freshness of files fetched by older versions is unknown,
+// they are taken as just expired.
+func staleUsable(metadata config.MetaFile, grace int) bool {
+	if metadata.MustRevalidate || grace <= 0 {
+		return false
 	}
+	if metadata.FreshUntil == 0 {
+		return true
+	}
+	return time.Since(time.Unix(metadata.FreshUntil, 0)) < time.Duration(grace)*time.Second
+}
+
+// revalidateRemoteImg sends a conditional GET for the fetched file of url, or a plain GET if there's none.
+// The stale file is kept within REMOTE_STALE_IF_ERROR past freshness if the upstream is down.
+func revalidateRemoteImg(url string, subdir string, header http.Header) remoteImage {
+	cacheKey := subdir + ":" + helper.HashString(url)
+	localRawImagePath := path.Join(config.Config.RemoteRawPath, subdir, helper.HashString(url)) + path.Ext(url)
 
-	if etag == "" {
-		log.Infof("Remote Addr is %s, pinging for info...", url)
-		etag = pingURL(url)
-		if etag != "" {
-			config.RemoteCache.Set(cacheKey, etag, cache.DefaultExpiration)
+	unlock := helper.LockCacheFile(localRawImagePath)
+	defer unlock()
+	// Another process sharing REMOTE_RAW_PATH may have fetched it while we were waiting for the lock
+	metadata, err := helper.LoadMetadata(url, subdir)
+	loaded := err == nil
+	cached := loaded && helper.ImageExists(localRawImagePath)
+
+	if header == nil {
+		header = upstreamHeader(config.MapOptions{}, nil)
+	}
+	header = header.Clone()
+	if cached {
+		if metadata.ETag != "" {
+			header.Set("If-None-Match", metadata.ETag)
+		}
+		if metadata.LastModified != "" {
+			header.Set("If-Modified-Since", metadata.LastModified)
 		}
 	}
 
-	metadata, err := helper.ReadMetadata(url, etag, subdir)
+	// Downloaded under a unique name, it's only moved into place if the upstream allows caching it
+	uncachedId, uncachedPath := uncachedRawPath(url, subdir)
+	log.Infof("Remote Addr is %s, fetching...", url)
+	resp, err := downloadFile(uncachedPath, url, header)
 	if err != nil {
-		log.Warnf("failed to read metadata for %s, rebuilding directly: %s", url, err)
-		metadata, err = helper.WriteMetadata(url, etag, subdir)
-		if err != nil {
-			log.Warnf("failed to write metadata for %s: %s", url, err)
+		log.Errorf("failed to fetch remote file %s: %s", url, err)
+		if cached && isUpstreamDown(err) && staleUsable(metadata, config.Config.RemoteStaleIfError) {
+			log.Warnf("Using stale cache for remote addr %s as the upstream is down", url)
+			return remoteImage{metadata: metadata, rawPath: localRawImagePath}
 		}
+		return remoteImage{metadata: metadata}
 	}
-	remoteFileExtension := path.Ext(url)
-	localRawImagePath := path.Join(config.Config.RemoteRawPath, subdir, metadata.Id) + remoteFileExtension
-	localExhaustImagePath := path.Join(config.Config.ExhaustPath, subdir, metadata.Id)
-
-	if !helper.ImageExists(localRawImagePath) || metadata.Checksum != helper.HashString(etag) {
-		cleanProxyCache(localExhaustImagePath)
-		if metadata.Checksum != helper.HashString(etag) {
-			// remote file has changed
-			log.Info("Remote file changed, updating metadata and fetching image source...")
-			helper.DeleteMetadata(url, subdir)
-			if _, err := helper.WriteMetadata(url, etag, subdir); err != nil {
-				log.Warnf("failed to update metadata for changed remote file %s: %s", url, err)
-			}
-		} else {
-			// local file not exists
-			log.Info("Remote file not found in remote-raw, re-fetching...")
+
+	freshness := parseFreshness(resp.Header, time.Now())
+	ttl := freshness.cacheTTL()
+	var freshUntil int64
+	if ttl >= 0 {
+		freshUntil = time.Now().Add(ttl).Unix()
+	}
+	switch {
+	case resp.StatusCode == fiber.StatusNotModified:
+		log.Infof("Remote file %s not modified", url)
+		metadata.MustRevalidate = freshness.mustRevalidate
+		metadata.FreshUntil = freshUntil
+		if err := helper.SaveMetadata(metadata, subdir); err != nil {
+			log.Warnf("failed to update metadata of %s: %s", url, err)
+		}
+	case freshness.noStore:
+		// Copies kept from earlier responses are outdated now
+		if loaded {
+			purgeImage(metadata, subdir)
 		}
-		_ = downloadFile(localRawImagePath, url)
-		// Update metadata with newly downloaded file
-		if _, err := helper.WriteMetadata(url, etag, subdir); err != nil {
+		uncached := helper.NewRemoteMetadata(url, uncachedPath, resp.Header.Get("ETag"), resp.Header.Get("Last-Modified"))
+		uncached.Id = uncachedId
+		return remoteImage{metadata: uncached, rawPath: uncachedPath, noStore: true}
+	default:
+		if err := os.Rename(uncachedPath, localRawImagePath); err != nil {
+			log.Errorf("failed to save remote file %s: %s", url, err)
+			_ = os.Remove(uncachedPath)
+			return remoteImage{metadata: metadata}
+		}
+		updated := helper.NewRemoteMetadata(url, localRawImagePath, resp.Header.Get("ETag"), resp.Header.Get("Last-Modified"))
+		updated.MustRevalidate = freshness.mustRevalidate
+		updated.FreshUntil = freshUntil
+		if err := helper.SaveMetadata(updated, subdir); err != nil {
 			log.Warnf("failed to update metadata after downloading %s: %s", url, err)
 		}
+		// Without metadata, converted images left behind can't be told apart from the new file
+		if !cached || updated.Checksum != metadata.Checksum {
+			log.Info("Remote file changed, removing converted images...")
+			cleanProxyCache(path.Join(config.Config.ExhaustPath, subdir, updated.Id))
+		}
+		metadata = updated
 	}
-	return metadata
-}
 
-func pingURL(url string) string {
-	// this function will try to return identifiable info, currently include etag, content-length as string
-	// anything goes wrong, will return ""
-	var etag, length string
-	resp, err := http.Head(url)
-	if err != nil {
-		log.Errorln("Connection to remote error when pingUrl:"+url, err)
-		return ""
+	if ttl != 0 {
+		config.RemoteCache.Set(cacheKey, metadata.Checksum, ttl)
+	} else {
+		config.RemoteCache.Delete(cacheKey)
 	}
-	defer resp.Body.Close()
+	return remoteImage{metadata: metadata, rawPath: localRawImagePath}
+}
 
-	if resp.StatusCode == fiber.StatusOK {
-		etag = resp.Header.Get("etag")
-		length = resp.Header.Get("content-length")
-	}
-	if etag == "" {
-		log.Info("Remote didn't return etag in header when getRemoteImageInfo, please check.")
+// upstreamStatusError is returned by downloadFile for responses other than 200 and 304
+type upstreamStatusError struct {
+	StatusCode int
+	Status     string
+}
+
+func (e upstreamStatusError) Error() string {
+	return "remote returned " + e.Status
+}
+
+// isUpstreamDown reports whether err of downloadFile means the upstream is unreachable or failing,
+// as opposed to an answer about the file itself like 404
+func isUpstreamDown(err error) bool {
+	var statusErr upstreamStatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode >= fiber.StatusInternalServerError
 	}
-	return etag + length
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// removeUncached removes raw and converted files of image once served, if the upstream doesn't allow caching it
+func removeUncached(image remoteImage, subdir string) {
+	cleanProxyCache(path.Join(config.Config.ExhaustPath, subdir, image.metadata.Id))
+	_ = os.Remove(image.rawPath)
 }
@@ -0,0 +1,347 @@
+package handler
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+	"webp_server_go/config"
+	"webp_server_go/helper"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/patrickmn/go-cache"
+	"github.com/stretchr/testify/assert"
+)
+
+func setupRemote(t *testing.T) {
+	t.Helper()
+	tmpDir := t.TempDir()
+	oldConfig := *config.Config
+	config.Config.ExhaustPath = path.Join(tmpDir, "exhaust")
+	config.Config.MetadataPath = path.Join(tmpDir, "metadata")
+	config.Config.RemoteRawPath = path.Join(tmpDir, "remote-raw")
+	config.RemoteCache = cache.New(cache.NoExpiration, 10*time.Minute)
+	t.Cleanup(func() { *config.Config = oldConfig })
+}
+
+// expireRemote makes the fetched file of url stale, as if its freshness had run out
+func expireRemote(t *testing.T, url string, subdir string) {
+	t.Helper()
+	config.RemoteCache.Flush()
+	metadata, err := helper.LoadMetadata(url, subdir)
+	assert.NoError(t, err)
+	metadata.FreshUntil = time.Now().Add(-time.Second).Unix()
+	assert.NoError(t, helper.SaveMetadata(metadata, subdir))
+}
+
+func TestFetchRemoteImgRevalidates(t *testing.T) {
+	setupRemote(t)
+	image, err := os.ReadFile("../pics/webp_server.png")
+	assert.NoError(t, err)
+	var etag atomic.Value
+	etag.Store(`"v1"`)
+	var requests, notModified atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		current := etag.Load().(string)
+		w.Header().Set("ETag", current)
+		if r.Header.Get("If-None-Match") == current {
+			notModified.Add(1)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		_, _ = w.Write(image)
+	}))
+	defer server.Close()
+
+	url := server.URL + "/webp_server.png"
+	subdir := "127.0.0.1"
+	metadata := fetchRemoteImg(url, subdir, nil).metadata
+	assert.Equal(t, `"v1"`, metadata.ETag)
+	assert.Equal(t, helper.HashString(`"v1"`), metadata.Checksum)
+	rawPath := path.Join(config.Config.RemoteRawPath, subdir, metadata.Id) + ".png"
+	assert.FileExists(t, rawPath)
+
+	// Fresh in RemoteCache, nothing is sent
+	fetchRemoteImg(url, subdir, nil)
+	assert.Equal(t, int32(1), requests.Load())
+
+	// Still fresh by metadata once RemoteCache is lost, e.g. after a restart, and RemoteCache is filled again
+	cacheKey := subdir + ":" + metadata.Id
+	config.RemoteCache.Flush()
+	fetchRemoteImg(url, subdir, nil)
+	assert.Equal(t, int32(1), requests.Load())
+	_, expiration, found := config.RemoteCache.GetWithExpiration(cacheKey)
+	assert.True(t, found)
+	assert.WithinDuration(t, time.Unix(metadata.FreshUntil, 0), expiration, time.Second)
+
+	// Revalidated once expired, 304 keeps converted images
+	exhaustPath := path.Join(config.Config.ExhaustPath, subdir, metadata.Id) + ".webp"
+	assert.NoError(t, os.MkdirAll(path.Dir(exhaustPath), 0755))
+	assert.NoError(t, os.WriteFile(exhaustPath, []byte("webp"), 0644))
+	expireRemote(t, url, subdir)
+	assert.Equal(t, metadata.Checksum, fetchRemoteImg(url, subdir, nil).metadata.Checksum)
+	assert.Equal(t, int32(1), notModified.Load())
+	assert.FileExists(t, exhaustPath)
+
+	// Changed upstream file replaces converted images
+	etag.Store(`"v2"`)
+	expireRemote(t, url, subdir)
+	metadata = fetchRemoteImg(url, subdir, nil).metadata
+	assert.Equal(t, `"v2"`, metadata.ETag)
+	assert.Equal(t, int32(3), requests.Load())
+	assert.NoFileExists(t, exhaustPath)
+}
+
+func TestFetchRemoteImgWithoutValidators(t *testing.T) {
+	setupRemote(t)
+	image, err := os.ReadFile("../pics/webp_server.png")
+	assert.NoError(t, err)
+	var conditional, down atomic.Bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") != "" || r.Header.Get("If-Modified-Since") != "" {
+			conditional.Store(true)
+		}
+		if down.Load() {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		_, _ = w.Write(image)
+	}))
+	defer server.Close()
+
+	url := server.URL + "/webp_server.png"
+	subdir := "127.0.0.1"
+	metadata := fetchRemoteImg(url, subdir, nil).metadata
+	rawPath := path.Join(config.Config.RemoteRawPath, subdir, metadata.Id) + ".png"
+	assert.Equal(t, helper.HashFile(rawPath), metadata.Checksum)
+
+	expireRemote(t, url, subdir)
+	assert.Equal(t, metadata.Checksum, fetchRemoteImg(url, subdir, nil).metadata.Checksum)
+	assert.False(t, conditional.Load())
+
+	// Cached file is kept when the upstream fails
+	down.Store(true)
+	expireRemote(t, url, subdir)
+	assert.Equal(t, metadata.Checksum, fetchRemoteImg(url, subdir, nil).metadata.Checksum)
+	assert.FileExists(t, rawPath)
+}
+
+func TestFetchRemoteImgCacheControl(t *testing.T) {
+	setupRemote(t)
+	image, err := os.ReadFile("../pics/webp_server.png")
+	assert.NoError(t, err)
+	var cacheControl atomic.Value
+	var down atomic.Bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if down.Load() {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.Header().Set("Cache-Control", cacheControl.Load().(string))
+		_, _ = w.Write(image)
+	}))
+	defer server.Close()
+	url := server.URL + "/webp_server.png"
+	subdir := "127.0.0.1"
+	cacheKey := subdir + ":" + helper.HashString(url)
+
+	// max-age sets freshness, and must-revalidate forbids serving the stale file once the upstream fails
+	cacheControl.Store("max-age=600, must-revalidate")
+	remote := fetchRemoteImg(url, subdir, nil)
+	assert.FileExists(t, remote.rawPath)
+	assert.True(t, remote.metadata.MustRevalidate)
+	_, expiration, found := config.RemoteCache.GetWithExpiration(cacheKey)
+	assert.True(t, found)
+	assert.WithinDuration(t, time.Now().Add(10*time.Minute), expiration, time.Minute)
+
+	down.Store(true)
+	expireRemote(t, url, subdir)
+	assert.Empty(t, fetchRemoteImg(url, subdir, nil).rawPath)
+
+	// no-store is kept under a unique name for this request only, earlier copies are removed
+	down.Store(false)
+	cacheControl.Store("no-store")
+	uncached := fetchRemoteImg(url, subdir, nil)
+	assert.True(t, uncached.noStore)
+	assert.NotEqual(t, remote.metadata.Id, uncached.metadata.Id)
+	assert.FileExists(t, uncached.rawPath)
+	assert.NoFileExists(t, remote.rawPath)
+	_, err = helper.LoadMetadata(url, subdir)
+	assert.Error(t, err)
+	_, found = config.RemoteCache.Get(cacheKey)
+	assert.False(t, found)
+
+	removeUncached(uncached, subdir)
+	assert.NoFileExists(t, uncached.rawPath)
+}
+
+func TestFetchRemoteImgStaleWhileRevalidate(t *testing.T) {
+	setupRemote(t)
+	config.Config.RemoteStaleWhileRevalidate = 60
+	image, err := os.ReadFile("../pics/webp_server.png")
+	assert.NoError(t, err)
+	release := make(chan struct{})
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) > 1 {
+			<-release
+		}
+		w.Header().Set("Cache-Control", "max-age=0")
+		_, _ = w.Write(image)
+	}))
+	defer server.Close()
+	url := server.URL + "/webp_server.png"
+	subdir := "127.0.0.1"
+
+	remote := fetchRemoteImg(url, subdir, nil)
+	assert.FileExists(t, remote.rawPath)
+
+	// Stale file is served at once, while the upstream is still answering its revalidation
+	stale := make(chan remoteImage)
+	go func() { stale <- fetchRemoteImg(url, subdir, nil) }()
+	select {
+	case image := <-stale:
+		assert.Equal(t, remote.rawPath, image.rawPath)
+		assert.True(t, image.stale)
+	case <-time.After(time.Second):
+		t.Fatal("stale file wasn't served while revalidating")
+	}
+	// Only one revalidation runs at a time
+	fetchRemoteImg(url, subdir, nil)
+	assert.Equal(t, 1, Refreshing())
+	close(release)
+	assert.Eventually(t, func() bool {
+		_, running := refreshing.Load(subdir + ":" + helper.HashString(url))
+		return !running && Refreshing() == 0
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, int32(2), requests.Load())
+}
+
+func TestFetchRemoteImgStaleIfError(t *testing.T) {
+	setupRemote(t)
+	config.Config.RemoteStaleIfError = 60
+	image, err := os.ReadFile("../pics/webp_server.png")
+	assert.NoError(t, err)
+	var status atomic.Int32
+	status.Store(http.StatusOK)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if code := int(status.Load()); code != http.StatusOK {
+			w.WriteHeader(code)
+			return
+		}
+		w.Header().Set("Cache-Control", "max-age=0")
+		_, _ = w.Write(image)
+	}))
+	url := server.URL + "/webp_server.png"
+	subdir := "127.0.0.1"
+	remote := fetchRemoteImg(url, subdir, nil)
+
+	// 404 is an answer about the file, not an upstream failure
+	status.Store(http.StatusNotFound)
+	assert.Empty(t, fetchRemoteImg(url, subdir, nil).rawPath)
+	status.Store(http.StatusServiceUnavailable)
+	assert.Equal(t, remote.rawPath, fetchRemoteImg(url, subdir, nil).rawPath)
+	server.Close()
+	assert.Equal(t, remote.rawPath, fetchRemoteImg(url, subdir, nil).rawPath)
+
+	// Not served once stale for longer than REMOTE_STALE_IF_ERROR
+	remote.metadata.FreshUntil = time.Now().Add(-2 * time.Minute).Unix()
+	assert.NoError(t, helper.SaveMetadata(remote.metadata, subdir))
+	assert.Empty(t, fetchRemoteImg(url, subdir, nil).rawPath)
+}
+
+func TestRemoteReplaced(t *testing.T) {
+	setupRemote(t)
+	url, subdir := "https://example.com/tsuki.jpg", "example.com"
+	metadata := config.MetaFile{Id: helper.HashString(url), Path: url, Checksum: "1"}
+	assert.NoError(t, helper.SaveMetadata(metadata, subdir))
+	_, replaced := remoteReplaced(url, subdir, "1")
+	assert.False(t, replaced)
+
+	// Saved by background revalidation once the upstream file changed
+	metadata.Checksum = "2"
+	assert.NoError(t, helper.SaveMetadata(metadata, subdir))
+	updated, replaced := remoteReplaced(url, subdir, "1")
+	assert.True(t, replaced)
+	assert.Equal(t, metadata, updated)
+}
+
+func TestStaleUsable(t *testing.T) {
+	now := time.Now()
+	assert.True(t, staleUsable(config.MetaFile{FreshUntil: now.Add(-time.Minute).Unix()}, 120))
+	assert.False(t, staleUsable(config.MetaFile{FreshUntil: now.Add(-time.Minute).Unix()}, 30))
+	assert.False(t, staleUsable(config.MetaFile{FreshUntil: now.Unix()}, 0))
+	assert.False(t, staleUsable(config.MetaFile{FreshUntil: now.Unix(), MustRevalidate: true}, 120))
+	assert.True(t, staleUsable(config.MetaFile{}, 120))
+}
+
+func TestConvertForwardedCookieIsPrivate(t *testing.T) {
+	setupRemote(t)
+	config.AllowAllExtensions = true
+	defer func() { config.AllowAllExtensions = false }()
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.Header().Set("Cache-Control", "max-age=600")
+		_, _ = w.Write([]byte("album of " + r.Header.Get("Cookie")))
+	}))
+	defer server.Close()
+	config.Config.ImgPath = server.URL
+	config.Config.AllowedTypes = []string{"*"}
+	config.Config.ImgPathOptions = config.MapOptions{ForwardHeaders: []string{"Cookie"}}
+
+	app := fiber.New()
+	app.Get("/*", Convert)
+	get := func(cookie string) string {
+		req := httptest.NewRequest(http.MethodGet, "/album.txt", nil)
+		req.Header.Set("Cookie", cookie)
+		resp, err := app.Test(req)
+		assert.NoError(t, err)
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return string(body)
+	}
+
+	assert.Equal(t, "album of user=alice", get("user=alice"))
+	assert.Equal(t, "album of user=bob", get("user=bob"))
+	assert.Equal(t, int32(2), requests.Load())
+	// Nothing is left for other clients
+	cached, _ := filepath.Glob(path.Join(config.Config.RemoteRawPath, "*", "*.txt"))
+	assert.Empty(t, cached)
+
+	// Credentials set in config are the same for all clients, the response is cached
+	config.Config.ImgPathOptions.Headers = map[string]string{"Cookie": "user=proxy"}
+	assert.Equal(t, "album of user=proxy", get("user=alice"))
+	cached, _ = filepath.Glob(path.Join(config.Config.RemoteRawPath, "*", "*.txt"))
+	assert.Len(t, cached, 1)
+}
+
+func TestConvertUpstreamQuery(t *testing.T) {
+	setupRemote(t)
+	image, err := os.ReadFile("../pics/webp_server.png")
+	assert.NoError(t, err)
+	queries := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queries <- r.URL.RawQuery
+		_, _ = w.Write(image)
+	}))
+	defer server.Close()
+	config.Config.ImgPath = server.URL
+	config.Config.EnableExtraParams = true
+	config.Config.Presets = map[string]config.Preset{"thumb": {"width": float64(100)}}
+
+	app := fiber.New()
+	app.Get("/*", Convert)
+
+	// Expanded and overriding params of the preset are not sent, the rest is kept as sent
+	resp, err := app.Test(httptest.NewRequest(http.MethodGet, "/webp_server.png?v=2&preset=thumb&height=50&a=%2F", nil))
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, "v=2&a=%2F", <-queries)
+}
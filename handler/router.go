@@ -1,21 +1,27 @@
 package handler
 
 import (
+	"errors"
 	"net/http"
 	"net/url"
+	"os"
 	"slices"
 	"strings"
 	"webp_server_go/config"
 	"webp_server_go/encoder"
 	"webp_server_go/helper"
+	"webp_server_go/metrics"
+	"webp_server_go/signature"
 
 	"path"
-	"strconv"
 
 	"github.com/gofiber/fiber/v2"
 	log "github.com/sirupsen/logrus"
 )
 
+// overloadRetryAfter is Retry-After in seconds of 503 responses when OVERLOAD_POLICY is reject
+const overloadRetryAfter = "5"
+
 func Convert(c *fiber.Ctx) error {
 	// this function need to do:
 	// 1. get request path, query string
@@ -23,37 +29,65 @@ func Convert(c *fiber.Ctx) error {
 	// 3. pass it to encoder, get the result, send it back
 
 	requestPath := c.Path()
+	// Extra params in path segment are moved to query, e.g. /_/w_300,h_200/tsuki.jpg -> /tsuki.jpg?width=300&height=200
+	var pathParams url.Values
+	if config.Config.EnablePathParams {
+		pathParams, requestPath, _ = signature.SplitPathParams(requestPath)
+	}
 	requestPathDecoded, _ := url.QueryUnescape(requestPath)
 	// For invalid or traversal-like paths, always return 404.
 	if !strings.HasPrefix(requestPath, "/") || hasTraversalSegments(requestPathDecoded) {
 		return sendNotFound(c)
 	}
 
+	// Signature has to be checked before any extra params are used
+	rawQuery := string(c.Request().URI().QueryString())
+	query, _ := url.ParseQuery(rawQuery)
+	originalURL := c.OriginalURL()
+	// Path params take precedence and are signed as if they were in query
+	for key, values := range pathParams {
+		query[key] = values
+	}
+	if config.Config.SignatureSecret != "" {
+		signedPath, _ := url.PathUnescape(requestPath)
+		if !checkSignature(signedPath, query) {
+			c.Status(http.StatusForbidden)
+			return c.SendString("Invalid or expired signature!")
+		}
+		// Only sig, expires and unsigned params are dropped, the rest of query goes upstream as it is
+		originalURL = withRawQuery(requestPath, rawQuery, query)
+	}
+	// Presets are expanded after signature check, so preset= itself doesn't need to be signed
+	variantIds := pathParams != nil || query.Get("preset") != ""
+	if query.Has("preset") || config.Config.PresetsOnly {
+		if !applyPreset(query) {
+			c.Status(http.StatusBadRequest)
+			return c.SendString("Unknown preset!")
+		}
+		// Only preset= and params removed by PRESETS_ONLY are dropped, expanded params are not sent upstream
+		originalURL = withRawQuery(requestPath, rawQuery, query)
+	}
+	if variantIds {
+		// Extra params are kept out of upstream URLs and cache keys, exhaust files use variant ids instead
+		originalURL = withRawQuery(requestPath, rawQuery, withoutParams(query, presetParams))
+	}
+
 	var (
 		err         error
 		reqHostname = c.Hostname()
 		reqHost     = c.Protocol() + "://" + reqHostname // http://www.example.com:8000
 		reqHeader   = &c.Request().Header
 
-		reqURIRaw, _          = url.QueryUnescape(c.Path())        // /mypic/123.jpg
-		reqURIwithQueryRaw, _ = url.QueryUnescape(c.OriginalURL()) // /mypic/123.jpg?someother=200&somebugs=200
-		reqURI                = path.Clean(reqURIRaw)              // delete ../ in reqURI to mitigate directory traversal
-		reqURIwithQuery       = path.Clean(reqURIwithQueryRaw)     // Sometimes reqURIwithQuery can be https://example.tld/mypic/123.jpg?someother=200&somebugs=200, we need to extract it
+		reqURIRaw, _          = url.QueryUnescape(requestPath) // /mypic/123.jpg
+		reqURIwithQueryRaw, _ = url.QueryUnescape(originalURL) // /mypic/123.jpg?someother=200&somebugs=200
+		reqURI                = path.Clean(reqURIRaw)          // delete ../ in reqURI to mitigate directory traversal
+		reqURIwithQuery       = path.Clean(reqURIwithQueryRaw) // Sometimes reqURIwithQuery can be https://example.tld/mypic/123.jpg?someother=200&somebugs=200, we need to extract it
 
 		filename = path.Base(reqURI)
 
 		meta = c.Query("meta") // Meta request
 
-		width, _     = strconv.Atoi(c.Query("width"))      // Extra Params
-		height, _    = strconv.Atoi(c.Query("height"))     // Extra Params
-		maxHeight, _ = strconv.Atoi(c.Query("max_height")) // Extra Params
-		maxWidth, _  = strconv.Atoi(c.Query("max_width"))  // Extra Params
-		extraParams  = config.ExtraParams{
-			Width:     width,
-			Height:    height,
-			MaxWidth:  maxWidth,
-			MaxHeight: maxHeight,
-		}
+		extraParams = helper.ParseExtraParams(query) // Extra Params
 	)
 
 	log.Debugf("Incoming connection from %s %s %s", c.IP(), reqHostname, reqURIwithQuery)
@@ -80,8 +114,8 @@ func Convert(c *fiber.Ctx) error {
 
 	if state.mode == requestModeRemoteDefault {
 		// Don't deal with the encoding to avoid upstream compatibilities
-		state.reqURI = c.Path()
-		state.reqURIWithQuery = c.OriginalURL()
+		state.reqURI = requestPath
+		state.reqURIWithQuery = originalURL
 	}
 
 	if state.isRemote() {
@@ -99,23 +133,34 @@ func Convert(c *fiber.Ctx) error {
 			if err != nil {
 				return sendNotFound(c)
 			}
-			return c.SendFile(localFilename)
+			return sendFile(c, localFilename)
 		} else {
 			// If the file is not in the ImgPath, we'll have to use the proxy mode to download it
-			_ = fetchRemoteImg(state.realRemoteAddr, state.targetHostName)
-			localFilename := path.Join(config.Config.RemoteRawPath, state.targetHostName, helper.HashString(state.realRemoteAddr)) + path.Ext(state.realRemoteAddr)
-			return c.SendFile(localFilename)
+			remote := fetchRemote(state, c)
+			if remote.rawPath == "" {
+				return sendNotFound(c)
+			}
+			if remote.noStore {
+				defer removeUncached(remote, state.targetHostName)
+			}
+			return sendFile(c, remote.rawPath)
 		}
 	}
 
 	var rawImageAbs string
 	var metadata = config.MetaFile{}
+	var staleRemote bool
 	if state.isRemote() {
 		// this is remote mode, we'll have to use this url to download and save it to local path, which also gives us rawImageAbs
 		// https://test.webp.sh/mypic/123.jpg?someother=200&somebugs=200
 
-		metadata = fetchRemoteImg(state.realRemoteAddr, state.targetHostName)
-		rawImageAbs = path.Join(config.Config.RemoteRawPath, state.targetHostName, metadata.Id) + path.Ext(state.realRemoteAddr)
+		remote := fetchRemote(state, c)
+		metadata, rawImageAbs, staleRemote = remote.metadata, remote.rawPath, remote.stale
+		if remote.noStore {
+			// Runs last, after Cache-Control of the image is set
+			defer c.Set(fiber.HeaderCacheControl, "no-store")
+			defer removeUncached(remote, state.targetHostName)
+		}
 	} else {
 		rawImageAbs, _ = resolveLocalRequestPath(state)
 	}
@@ -135,14 +180,33 @@ func Convert(c *fiber.Ctx) error {
 				log.Warnf("failed to build metadata for %s: %s", state.reqURIWithQuery, err)
 			}
 		}
-		// detect if source file has changed
-		if metadata.Checksum != helper.HashFile(rawImageAbs) {
-			log.Info("Source file has changed, re-encoding...")
-			metadata, err = helper.WriteMetadata(state.reqURIWithQuery, "", state.targetHostName)
-			if err != nil {
-				log.Warnf("failed to refresh metadata for %s: %s", state.reqURIWithQuery, err)
+	}
+
+	if variantIds {
+		metadata.Id = helper.VariantId(metadata.Id, extraParams)
+	}
+
+	supportedFormats := helper.GuessSupportedFormat(reqHeader)
+
+	// HEAD and conditional requests are answered from cached files without hashing the source or encoding
+	if meta != "full" && isHeadOrConditional(c) {
+		if filename, negotiated, _ := variantFile(rawImageAbs, metadata, state, extraParams, supportedFormats, false); filename != "" {
+			if answered, err := sendCachedHeaders(c, state, metadata, rawImageAbs, filename, negotiated); answered {
+				return err
 			}
-			cleanProxyCache(path.Join(config.Config.ExhaustPath, state.targetHostName, metadata.Id))
+		}
+	}
+
+	// detect if source file has changed
+	if !state.isRemote() && metadata.Checksum != helper.HashFile(rawImageAbs) {
+		log.Info("Source file has changed, re-encoding...")
+		metadata, err = helper.WriteMetadata(state.reqURIWithQuery, "", state.targetHostName)
+		if err != nil {
+			log.Warnf("failed to refresh metadata for %s: %s", state.reqURIWithQuery, err)
+		}
+		cleanProxyCache(path.Join(config.Config.ExhaustPath, state.targetHostName, metadata.Id))
+		if variantIds {
+			metadata.Id = helper.VariantId(metadata.Id, extraParams)
 		}
 	}
 
@@ -159,9 +223,54 @@ func Convert(c *fiber.Ctx) error {
 		})
 	}
 
-	supportedFormats := helper.GuessSupportedFormat(reqHeader)
-	// resize itself and return if only raw(jpg,jpeg,png,gif) is supported
-	if supportedFormats["jpg"] == true &&
+	// Exhaust cache hit means nothing has to be encoded for this request
+	cachedFilename, _, _ := variantFile(rawImageAbs, metadata, state, extraParams, supportedFormats, false)
+	metrics.ExhaustCache(cachedFilename != "")
+
+	finalFilename, negotiated, err := variantFile(rawImageAbs, metadata, state, extraParams, supportedFormats, true)
+	if staleRemote && cachedFilename == "" && err == nil {
+		if updated, replaced := remoteReplaced(state.realRemoteAddr, state.targetHostName, metadata.Checksum); replaced {
+			log.Info("Remote file changed while it was converted, converting it again...")
+			cleanProxyCache(path.Join(config.Config.ExhaustPath, state.targetHostName, updated.Id))
+			metadata = updated
+			if variantIds {
+				metadata.Id = helper.VariantId(metadata.Id, extraParams)
+			}
+			finalFilename, negotiated, err = variantFile(rawImageAbs, metadata, state, extraParams, supportedFormats, true)
+		}
+	}
+	if errors.Is(err, encoder.ErrOverloaded) {
+		if config.Config.OverloadPolicy != "original" {
+			c.Set(fiber.HeaderRetryAfter, overloadRetryAfter)
+			return c.SendStatus(http.StatusServiceUnavailable)
+		}
+		// Original image is only a stopgap, it shouldn't be cached in place of the optimized one
+		finalFilename, negotiated = rawImageAbs, false
+		defer c.Set(fiber.HeaderCacheControl, "no-store")
+	}
+	c.Set("X-Compression-Rate", helper.GetCompressionRate(rawImageAbs, finalFilename))
+	if err := sendImage(c, state, metadata, finalFilename, negotiated); err != nil || c.Response().StatusCode() != http.StatusOK || c.Method() == fiber.MethodHead {
+		return err
+	}
+	metrics.AddBytesSaved(fileSize(rawImageAbs), fileSize(finalFilename))
+	return nil
+}
+
+// fileSize returns size of filename, or 0 if it can't be stat
+func fileSize(filename string) int64 {
+	info, err := os.Stat(filename)
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
+
+// variantFile returns the file to serve for extraParams and supportedFormats, and whether it was chosen by content negotiation.
+// If convert is false nothing is encoded, and "" is returned unless all files needed for the choice are already in cache.
+// encoder.ErrOverloaded is returned if the conversion pool is too busy to encode them.
+func variantFile(rawImageAbs string, metadata config.MetaFile, state requestState, extraParams config.ExtraParams, supportedFormats map[string]bool, convert bool) (string, bool, error) {
+	// resize itself and return if only raw(jpg,jpeg,png,gif) is supported or original format is requested
+	if extraParams.Format == "original" || supportedFormats["jpg"] == true &&
 		supportedFormats["jpeg"] == true &&
 		supportedFormats["png"] == true &&
 		supportedFormats["gif"] == true &&
@@ -169,36 +278,67 @@ func Convert(c *fiber.Ctx) error {
 		supportedFormats["avif"] == false &&
 		supportedFormats["jxl"] == false &&
 		supportedFormats["heic"] == false {
-		dest := path.Join(config.Config.ExhaustPath, state.targetHostName, metadata.Id)
+		dest := helper.GenResizedAbsPath(metadata, state.targetHostName)
 		if !helper.ImageExists(dest) {
-			encoder.ResizeItself(rawImageAbs, dest, extraParams)
+			if !convert {
+				return "", false, nil
+			}
+			if err := encoder.ResizeItself(rawImageAbs, dest, extraParams); err != nil {
+				return "", false, err
+			}
 		}
-		return c.SendFile(dest)
+		return dest, extraParams.Format != "original", nil
 	}
 
 	avifAbs, webpAbs, jxlAbs := helper.GenOptimizedAbsPath(metadata, state.targetHostName)
+
+	if forcedAbs := forcedFormatAbs(extraParams.Format, avifAbs, webpAbs, jxlAbs); forcedAbs != "" {
+		// format= bypasses content negotiation and the smallest file choice
+		if convert {
+			if err := encoder.ConvertFilter(rawImageAbs, jxlAbs, avifAbs, webpAbs, extraParams, map[string]bool{extraParams.Format: true}, nil); errors.Is(err, encoder.ErrOverloaded) {
+				return "", false, err
+			}
+		}
+		if helper.ImageExists(forcedAbs) {
+			return forcedAbs, false, nil
+		}
+		if !convert {
+			return "", false, nil
+		}
+		log.Warnf("failed to convert %s to %s, falling back to supported formats", rawImageAbs, extraParams.Format)
+	}
+
 	// Do the convertion based on supported formats and config
-	encoder.ConvertFilter(rawImageAbs, jxlAbs, avifAbs, webpAbs, extraParams, supportedFormats, nil)
+	if convert {
+		// Other conversion errors are logged, the smallest file available is served instead
+		if err := encoder.ConvertFilter(rawImageAbs, jxlAbs, avifAbs, webpAbs, extraParams, supportedFormats, nil); errors.Is(err, encoder.ErrOverloaded) {
+			return "", false, err
+		}
+	}
 
 	var availableFiles = []string{}
 	// If source image is in jpg/jpeg/png/gif, we can add it to the available files
 	if slices.Contains([]string{"jpg", "jpeg", "png", "gif"}, helper.GetImageExtension(rawImageAbs)) {
 		availableFiles = append(availableFiles, rawImageAbs)
 	}
-	if supportedFormats["avif"] {
-		availableFiles = append(availableFiles, avifAbs)
-	}
-	if supportedFormats["webp"] {
-		availableFiles = append(availableFiles, webpAbs)
-	}
-	if supportedFormats["jxl"] {
-		availableFiles = append(availableFiles, jxlAbs)
+	for _, candidate := range []struct {
+		format  string
+		enabled bool
+		abs     string
+	}{
+		{"avif", config.Config.EnableAVIF, avifAbs},
+		{"webp", config.Config.EnableWebP, webpAbs},
+		{"jxl", config.Config.EnableJXL, jxlAbs},
+	} {
+		if !supportedFormats[candidate.format] {
+			continue
+		}
+		// Smallest file can't be known until every format ConvertFilter would encode is in cache
+		if !convert && candidate.enabled && !helper.ImageExists(candidate.abs) {
+			return "", false, nil
+		}
+		availableFiles = append(availableFiles, candidate.abs)
 	}
 
-	finalFilename := helper.FindSmallestFiles(availableFiles)
-	contentType := helper.GetFileContentType(finalFilename)
-	c.Set("Content-Type", contentType)
-
-	c.Set("X-Compression-Rate", helper.GetCompressionRate(rawImageAbs, finalFilename))
-	return c.SendFile(finalFilename)
+	return helper.FindSmallestFiles(availableFiles), true, nil
 }
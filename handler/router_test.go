@@ -6,13 +6,16 @@ import (
 	"net/http/httptest"
 	"net/url"
 	"os"
+	"path"
+	"strings"
 	"testing"
 	"time"
 	"webp_server_go/config"
 	"webp_server_go/helper"
+	"webp_server_go/signature"
 
+	"github.com/davidbyttow/govips/v2/vips"
 	"github.com/gofiber/fiber/v2"
-	"github.com/gofiber/fiber/v2/middleware/etag"
 	"github.com/patrickmn/go-cache"
 	"github.com/stretchr/testify/assert"
 )
@@ -39,6 +42,8 @@ func setupParam() {
 	config.Config.EnableAVIF = false
 	config.Config.Quality = 80
 	config.Config.ImageMap = map[string]string{}
+	config.Config.SignatureSecret = ""
+	config.Config.SignatureFallback = "reject"
 	config.AllowAllExtensions = false
 	config.RemoteCache = cache.New(cache.NoExpiration, 10*time.Minute)
 }
@@ -90,10 +95,11 @@ func requestMalformedPathToServer(rawPath string, host string, app *fiber.App, u
 
 func TestServerHeaders(t *testing.T) {
 	setupParam()
+	config.Config.CacheControl = "public, max-age=86400"
+	defer func() {
+		config.Config.CacheControl = ""
+	}()
 	var app = fiber.New()
-	app.Use(etag.New(etag.Config{
-		Weak: true,
-	}))
 	app.Get("/*", Convert)
 	url := "http://127.0.0.1:3333/webp_server.bmp"
 
@@ -105,14 +111,28 @@ func TestServerHeaders(t *testing.T) {
 
 	assert.NotEqual(t, "", ratio)
 	assert.NotEqual(t, "", etag)
+	assert.False(t, strings.HasPrefix(etag, "W/"))
+	assert.Equal(t, "Accept, User-Agent", response.Header.Get("Vary"))
+	assert.Equal(t, "public, max-age=86400", response.Header.Get("Cache-Control"))
 
 	// test for safari
 	response, _ = requestToServer(url, app, safariUA, acceptLegacy)
 	defer response.Body.Close()
 	// ratio = response.Header.Get("X-Compression-Rate")
-	etag = response.Header.Get("Etag")
+	safariEtag := response.Header.Get("Etag")
 
-	assert.NotEqual(t, "", etag)
+	assert.NotEqual(t, "", safariEtag)
+	assert.NotEqual(t, etag, safariEtag)
+
+	// matching ETag is answered with 304
+	req := httptest.NewRequest("GET", "/webp_server.bmp", nil)
+	req.Header.Set("User-Agent", chromeUA)
+	req.Header.Set("Accept", acceptWebP)
+	req.Header.Set("If-None-Match", etag)
+	response, _ = app.Test(req, 120000)
+	defer response.Body.Close()
+	assert.Equal(t, http.StatusNotModified, response.StatusCode)
+	assert.Equal(t, etag, response.Header.Get("Etag"))
 }
 
 func TestConvertDuplicates(t *testing.T) {
@@ -257,6 +277,15 @@ func TestConvertPassThrough(t *testing.T) {
 	assert.Equal(t, http.StatusOK, resp.StatusCode)
 	assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
 	assert.Contains(t, string(data), "HOST")
+	etag := resp.Header.Get("Etag")
+	assert.NotEqual(t, "", etag)
+
+	req := httptest.NewRequest(http.MethodGet, "/config.json", nil)
+	req.Header.Set("If-None-Match", etag)
+	resp, err := app.Test(req, 120000)
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusNotModified, resp.StatusCode)
 }
 
 func TestConvertPathTraversalBlocked(t *testing.T) {
@@ -538,3 +567,270 @@ func TestConvertedFileIsBigger(t *testing.T) {
 	assert.Equal(t, "image/jpeg", helper.GetContentType(data))
 	_ = os.RemoveAll(config.Config.ExhaustPath)
 }
+
+func TestConvertSignedParams(t *testing.T) {
+	setupParam()
+	config.Config.EnableExtraParams = true
+	config.Config.SignatureSecret = "s3cr3t"
+	defer func() {
+		config.Config.EnableExtraParams = false
+		config.Config.SignatureSecret = ""
+	}()
+
+	var app = fiber.New()
+	app.Get("/*", Convert)
+
+	// no params, no signature needed
+	resp, _ := requestRawPathToServer("/webp_server.jpg", "127.0.0.1:3333", app, chromeUA, acceptWebP)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// unsigned params are rejected
+	resp, _ = requestRawPathToServer("/webp_server.jpg?width=100", "127.0.0.1:3333", app, chromeUA, acceptWebP)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	// expired signature is rejected
+	expired, _ := signature.SignURL("s3cr3t", "/webp_server.jpg?width=100", time.Now().Add(-time.Minute))
+	resp, _ = requestRawPathToServer(expired, "127.0.0.1:3333", app, chromeUA, acceptWebP)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	signed, _ := signature.SignURL("s3cr3t", "/webp_server.jpg?width=100", time.Now().Add(time.Minute))
+	resp, data := requestRawPathToServer(signed, "127.0.0.1:3333", app, chromeUA, acceptWebP)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "image/webp", helper.GetContentType(data))
+
+	assert.Equal(t, 100, imageWidth(t, data))
+
+	// format is signed as well
+	resp, _ = requestRawPathToServer("/webp_server.jpg?format=avif", "127.0.0.1:3333", app, chromeUA, acceptWebP)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	// unsigned params are served in original size with fallback
+	config.Config.SignatureFallback = "original"
+	original, err := vips.NewImageFromFile("../pics/webp_server.jpg")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer original.Close()
+	for _, unsigned := range []string{"/webp_server.jpg?width=100", "/webp_server.jpg?format=avif"} {
+		resp, data = requestRawPathToServer(unsigned, "127.0.0.1:3333", app, chromeUA, acceptWebP)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "image/webp", helper.GetContentType(data))
+		assert.Equal(t, original.Width(), imageWidth(t, data), unsigned)
+	}
+}
+
+func imageWidth(t *testing.T, data []byte) int {
+	t.Helper()
+	img, err := vips.NewImageFromBuffer(data)
+	if !assert.NoError(t, err) {
+		return 0
+	}
+	defer img.Close()
+	return img.Width()
+}
+
+func TestConvertFormatOverride(t *testing.T) {
+	setupParam()
+	config.Config.EnableAVIF = true
+	defer func() {
+		config.Config.EnableAVIF = false
+	}()
+
+	var app = fiber.New()
+	app.Get("/*", Convert)
+
+	var testLinks = []struct {
+		path     string
+		ua       string
+		accept   string
+		respType string
+	}{
+		// format=original returns the original format even if the browser supports WebP
+		{"/webp_server.jpg?format=original", chromeUA, acceptWebP, "image/jpeg"},
+		{"/webp_server.png?format=original", chromeUA, acceptWebP, "image/png"},
+		// format=avif is used even if the browser doesn't announce AVIF support
+		{"/webp_server.jpg?format=avif", chromeUA, acceptWebP, "image/avif"},
+		{"/webp_server.jpg?format=webp", safariUA, acceptLegacy, "image/webp"},
+		// JXL is not in CONVERT_TYPES, so content negotiation is used
+		{"/webp_server.jpg?format=jxl", chromeUA, acceptWebP, "image/webp"},
+		// Invalid format is ignored
+		{"/webp_server.jpg?format=tiff", chromeUA, acceptWebP, "image/webp"},
+	}
+
+	for _, tc := range testLinks {
+		resp, data := requestRawPathToServer(tc.path, "127.0.0.1:3333", app, tc.ua, tc.accept)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode, tc.path)
+		assert.Equal(t, tc.respType, helper.GetContentType(data), tc.path)
+	}
+}
+
+func TestConvertPreset(t *testing.T) {
+	setupParam()
+	config.Config.EnableExtraParams = true
+	config.Config.SignatureSecret = "s3cr3t"
+	config.Config.Presets = map[string]config.Preset{"thumb": {"width": float64(100)}}
+	defer func() {
+		config.Config.EnableExtraParams = false
+		config.Config.SignatureSecret = ""
+		config.Config.Presets = map[string]config.Preset{}
+	}()
+
+	var app = fiber.New()
+	app.Get("/*", Convert)
+
+	// presets don't need a signature
+	resp, data := requestRawPathToServer("/webp_server.jpg?preset=thumb", "127.0.0.1:3333", app, chromeUA, acceptWebP)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "image/webp", helper.GetContentType(data))
+
+	resp, _ = requestRawPathToServer("/webp_server.jpg?preset=banner", "127.0.0.1:3333", app, chromeUA, acceptWebP)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestConvertPathParams(t *testing.T) {
+	setupParam()
+	config.Config.EnableExtraParams = true
+	config.Config.EnablePathParams = true
+	defer func() {
+		config.Config.EnableExtraParams = false
+		config.Config.EnablePathParams = false
+	}()
+
+	var app = fiber.New()
+	app.Get("/*", Convert)
+
+	resp, data := requestRawPathToServer("/_/w_100,h_100/webp_server.jpg", "127.0.0.1:3333", app, chromeUA, acceptWebP)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "image/webp", helper.GetContentType(data))
+
+	resp, _ = requestRawPathToServer("/_/w_100/../../config.json", "127.0.0.1:3333", app, chromeUA, acceptWebP)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	// Path params are signed like query params
+	config.Config.SignatureSecret = "s3cr3t"
+	resp, _ = requestRawPathToServer("/_/w_100,h_100/webp_server.jpg", "127.0.0.1:3333", app, chromeUA, acceptWebP)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	signed, _ := signature.SignURL("s3cr3t", "/_/w_100,h_100/webp_server.jpg", time.Now().Add(time.Minute))
+	resp, data = requestRawPathToServer(signed, "127.0.0.1:3333", app, chromeUA, acceptWebP)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "image/webp", helper.GetContentType(data))
+	config.Config.SignatureSecret = ""
+
+	// Path params are ignored when disabled
+	config.Config.EnablePathParams = false
+	resp, _ = requestRawPathToServer("/_/w_100,h_100/webp_server.jpg", "127.0.0.1:3333", app, chromeUA, acceptWebP)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestConvertHeadAndConditional(t *testing.T) {
+	setupParam()
+	// Original is the only candidate, so it can be answered from cache without encoding
+	config.Config.EnableWebP = false
+
+	var app = fiber.New()
+	app.Get("/*", Convert)
+
+	request := func(method string, header map[string]string) (*http.Response, []byte) {
+		req := httptest.NewRequest(method, "/webp_server.jpg", nil)
+		req.Header.Set("User-Agent", chromeUA)
+		req.Header.Set("Accept", acceptWebP)
+		for key, value := range header {
+			req.Header.Set(key, value)
+		}
+		resp, err := app.Test(req, 120000)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		return resp, data
+	}
+
+	resp, body := request(http.MethodGet, nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	etag := resp.Header.Get("Etag")
+	assert.NotEqual(t, "", etag)
+
+	resp, data := request(http.MethodHead, nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Empty(t, data)
+	assert.Equal(t, etag, resp.Header.Get("Etag"))
+	assert.Equal(t, "image/jpeg", resp.Header.Get("Content-Type"))
+	assert.Equal(t, int64(len(body)), resp.ContentLength)
+	lastModified := resp.Header.Get("Last-Modified")
+	assert.NotEqual(t, "", lastModified)
+
+	resp, data = request(http.MethodGet, map[string]string{"If-None-Match": etag})
+	assert.Equal(t, http.StatusNotModified, resp.StatusCode)
+	assert.Empty(t, data)
+
+	resp, _ = request(http.MethodGet, map[string]string{"If-Modified-Since": lastModified})
+	assert.Equal(t, http.StatusNotModified, resp.StatusCode)
+
+	// Stale validators get the full response
+	resp, data = request(http.MethodGet, map[string]string{"If-None-Match": `"stale"`})
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, body, data)
+
+	// Cached optimized variants are answered with their own ETag and Vary, without converting
+	for _, variant := range []struct {
+		format string
+		accept string
+		cached string
+	}{
+		{"webp", acceptWebP, "../pics/big.webp"},
+		{"avif", acceptAvif, "../pics/kimono.avif"},
+	} {
+		config.Config.ExhaustPath = t.TempDir()
+		config.Config.EnableWebP = variant.format == "webp"
+		config.Config.EnableAVIF = variant.format == "avif"
+		metadata, err := helper.WriteMetadata("/webp_server.jpg", "", config.LocalHostAlias)
+		assert.NoError(t, err)
+		avifAbs, webpAbs, _ := helper.GenOptimizedAbsPath(metadata, config.LocalHostAlias)
+		variantAbs := map[string]string{"webp": webpAbs, "avif": avifAbs}[variant.format]
+		cached, err := os.ReadFile(variant.cached)
+		assert.NoError(t, err)
+		assert.NoError(t, os.MkdirAll(path.Dir(variantAbs), 0755))
+		assert.NoError(t, os.WriteFile(variantAbs, cached, 0644))
+		stat, err := os.Stat(variantAbs)
+		assert.NoError(t, err)
+		header := map[string]string{"Accept": variant.accept}
+
+		resp, data := request(http.MethodHead, header)
+		assert.Equal(t, http.StatusOK, resp.StatusCode, variant.format)
+		assert.Empty(t, data)
+		variantEtag := resp.Header.Get("Etag")
+		assert.Equal(t, variantETag(metadata, variantAbs), variantEtag, variant.format)
+		assert.NotEqual(t, etag, variantEtag, variant.format)
+		assert.Equal(t, "image/"+variant.format, resp.Header.Get("Content-Type"), variant.format)
+		assert.Equal(t, int64(len(cached)), resp.ContentLength, variant.format)
+		assert.Equal(t, "Accept, User-Agent", resp.Header.Get("Vary"), variant.format)
+
+		resp, data = request(http.MethodGet, map[string]string{"Accept": variant.accept, "If-None-Match": variantEtag})
+		assert.Equal(t, http.StatusNotModified, resp.StatusCode, variant.format)
+		assert.Empty(t, data)
+		assert.Equal(t, variantEtag, resp.Header.Get("Etag"), variant.format)
+		assert.Equal(t, "Accept, User-Agent", resp.Header.Get("Vary"), variant.format)
+
+		resp, _ = request(http.MethodHead, map[string]string{"Accept": variant.accept, "If-None-Match": variantEtag})
+		assert.Equal(t, http.StatusNotModified, resp.StatusCode, variant.format)
+
+		after, err := os.Stat(variantAbs)
+		assert.NoError(t, err)
+		assert.Equal(t, stat.ModTime(), after.ModTime(), "%s variant was converted again", variant.format)
+	}
+}
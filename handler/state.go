@@ -25,6 +25,7 @@ type requestState struct {
 	targetHostName  string
 	targetHost      string
 	mapLocalBase    string
+	mapKey          string // matching IMG_MAP key, if any
 	realRemoteAddr  string
 }
 
@@ -36,6 +37,14 @@ func (r requestState) isLocalMapped() bool {
 	return r.mode == requestModeLocalMapped
 }
 
+// options returns IMG_MAP_OPTIONS of the matching IMG_MAP entry, or IMG_PATH_OPTIONS if there's none
+func (r requestState) options() config.MapOptions {
+	if r.mapKey != "" {
+		return config.Config.ImageMapOptions[r.mapKey]
+	}
+	return config.Config.ImgPathOptions
+}
+
 func resolveRequestState(reqHost string, reqHostname string, state *requestState) {
 	// Rewrite the target backend if a mapping rule matches the hostname
 	if hostMap, hostMapFound := config.Config.ImageMap[reqHost]; hostMapFound {
@@ -44,6 +53,7 @@ func resolveRequestState(reqHost string, reqHostname string, state *requestState
 		state.targetHostName = targetHostURL.Host
 		state.targetHost = targetHostURL.Scheme + "://" + targetHostURL.Host
 		state.mode = requestModeRemoteDefault
+		state.mapKey = reqHost
 		return
 	}
 
@@ -52,6 +62,7 @@ func resolveRequestState(reqHost string, reqHostname string, state *requestState
 	for uriMap, uriMapTarget := range config.Config.ImageMap {
 		if strings.HasPrefix(state.reqURI, uriMap) {
 			log.Debugf("Found URI mapping %s -> %s", uriMap, uriMapTarget)
+			state.mapKey = uriMap
 
 			// if uriMapTarget is URL, use remote mode to fetch upstream.
 			if httpRegexpMatcher.Match([]byte(uriMapTarget)) {
@@ -0,0 +1,152 @@
+package handler
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+	"webp_server_go/config"
+
+	"github.com/gofiber/fiber/v2"
+	log "github.com/sirupsen/logrus"
+)
+
+// defaultUserAgent is sent to upstreams without USER_AGENT in their options
+var defaultUserAgent = "WebP-Server-Go/" + config.Version
+
+// upstreamClient returns the HTTP client for remote backends, built from UPSTREAM on first use
+var upstreamClient = sync.OnceValue(func() *http.Client {
+	return newUpstreamClient(config.Config.Upstream)
+})
+
+// newUpstreamClient builds a client from options, invalid PROXY or CA_FILE is logged and ignored
+func newUpstreamClient(options config.UpstreamOptions) *http.Client {
+	connectTimeout := time.Duration(options.ConnectTimeout) * time.Second
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   connectTimeout,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSHandshakeTimeout: connectTimeout,
+		MaxConnsPerHost:     options.MaxConnsPerHost,
+		MaxIdleConnsPerHost: options.MaxConnsPerHost,
+		IdleConnTimeout:     90 * time.Second,
+		ForceAttemptHTTP2:   true,
+	}
+
+	if options.Proxy != "" {
+		proxyURL, err := url.Parse(options.Proxy)
+		if err != nil {
+			log.Errorf("UPSTREAM PROXY %s is not a valid URL, using proxy from env: %s", options.Proxy, err)
+		} else {
+			transport.Proxy = http.ProxyURL(proxyURL)
+		}
+	}
+
+	if options.CAFile != "" {
+		rootCAs, err := loadCAFile(options.CAFile)
+		if err != nil {
+			log.Errorf("failed to load UPSTREAM CA_FILE, using system CAs only: %s", err)
+		} else {
+			transport.TLSClientConfig = &tls.Config{RootCAs: rootCAs}
+		}
+	}
+
+	return &http.Client{
+		Transport: transport,
+		Timeout:   time.Duration(options.ReadTimeout) * time.Second,
+	}
+}
+
+// loadCAFile returns system CAs plus certificates in PEM bundle caFile
+func loadCAFile(caFile string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	rootCAs, err := x509.SystemCertPool()
+	if err != nil {
+		rootCAs = x509.NewCertPool()
+	}
+	if !rootCAs.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificate found in %s", caFile)
+	}
+	return rootCAs, nil
+}
+
+// maxBodySize returns UPSTREAM MAX_BODY_SIZE in bytes, 0 means no limit
+func maxBodySize() int64 {
+	return int64(config.Config.Upstream.MaxBodySize) * 1024 * 1024
+}
+
+// upstreamHeader returns request headers for the upstream of options. Allowed headers are forwarded from
+// client request c if it isn't nil, and are overridden by static HEADERS, USER_AGENT and credentials.
+func upstreamHeader(options config.MapOptions, c *fiber.Ctx) http.Header {
+	header := http.Header{}
+	header.Set("User-Agent", defaultUserAgent)
+	if c != nil {
+		for _, name := range options.ForwardHeaders {
+			if value := c.Get(name); value != "" {
+				// Values of c are only valid within the handler, while header may be used by background revalidation
+				header.Set(name, strings.Clone(value))
+			}
+		}
+	}
+	for name, value := range options.Headers {
+		header.Set(name, value)
+	}
+	if options.UserAgent != "" {
+		header.Set("User-Agent", options.UserAgent)
+	}
+	if options.BearerToken != "" {
+		header.Set("Authorization", "Bearer "+options.BearerToken)
+	} else if options.BasicAuth != "" {
+		header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(options.BasicAuth)))
+	}
+	return header
+}
+
+// credentialHeaders are forwarded headers that may make the upstream answer differently per client
+var credentialHeaders = []string{"Cookie", "Authorization"}
+
+// forwardsCredentials reports whether upstreamHeader forwards credentials of client c for options, i.e. the
+// response is private to c. Credentials overridden by static HEADERS, BEARER_TOKEN or BASIC_AUTH are the same
+// for all clients and don't count.
+func forwardsCredentials(options config.MapOptions, c *fiber.Ctx) bool {
+	static := http.Header{}
+	for name, value := range options.Headers {
+		static.Set(name, value)
+	}
+	if options.BearerToken != "" || options.BasicAuth != "" {
+		static.Set("Authorization", "static")
+	}
+	for _, name := range options.ForwardHeaders {
+		name = http.CanonicalHeaderKey(name)
+		if slices.Contains(credentialHeaders, name) && static.Get(name) == "" && c.Get(name) != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// newUpstreamRequest returns a request to url with header, nil header means default headers only
+func newUpstreamRequest(method string, url string, header http.Header) (*http.Request, error) {
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if header == nil {
+		header = upstreamHeader(config.MapOptions{}, nil)
+	}
+	req.Header = header.Clone()
+	return req, nil
+}
@@ -0,0 +1,153 @@
+package handler
+
+import (
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strconv"
+	"testing"
+	"webp_server_go/config"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewUpstreamClientCAFile(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	options := config.NewWebPConfig().Upstream
+	_, err := newUpstreamClient(options).Get(server.URL)
+	assert.Error(t, err)
+
+	options.CAFile = path.Join(t.TempDir(), "ca.pem")
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	assert.NoError(t, os.WriteFile(options.CAFile, certPEM, 0644))
+	resp, err := newUpstreamClient(options).Get(server.URL)
+	assert.NoError(t, err)
+	if err == nil {
+		resp.Body.Close()
+	}
+}
+
+func TestDownloadFileLimits(t *testing.T) {
+	image, err := os.ReadFile("../pics/webp_server.png")
+	assert.NoError(t, err)
+	// Image is larger than 1MB in total
+	large := append(image, make([]byte, 1024*1024)...)
+	exact := large[:1024*1024]
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/sized.png":
+			w.Header().Set("Content-Length", strconv.Itoa(len(image)))
+			_, _ = w.Write(image)
+		case "/large.png":
+			w.Header().Set("Content-Length", strconv.Itoa(len(large)))
+			_, _ = w.Write(large)
+		case "/chunked.png":
+			// Without Content-Length the limit is only hit while streaming
+			w.(http.Flusher).Flush()
+			_, _ = w.Write(large)
+		case "/exact.png":
+			w.(http.Flusher).Flush()
+			_, _ = w.Write(exact)
+		case "/text.png":
+			_, _ = w.Write([]byte("not an image"))
+		}
+	}))
+	defer server.Close()
+
+	oldMaxBodySize := config.Config.Upstream.MaxBodySize
+	defer func() { config.Config.Upstream.MaxBodySize = oldMaxBodySize }()
+	dir := t.TempDir()
+
+	config.Config.Upstream.MaxBodySize = 1
+	_, err = downloadFile(path.Join(dir, "sized.png"), server.URL+"/sized.png", nil)
+	assert.NoError(t, err)
+	assert.FileExists(t, path.Join(dir, "sized.png"))
+	_, err = downloadFile(path.Join(dir, "text.png"), server.URL+"/text.png", nil)
+	assert.Error(t, err)
+	assert.NoFileExists(t, path.Join(dir, "text.png"))
+
+	_, err = downloadFile(path.Join(dir, "large.png"), server.URL+"/large.png", nil)
+	assert.Error(t, err)
+	_, err = downloadFile(path.Join(dir, "chunked.png"), server.URL+"/chunked.png", nil)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "larger than UPSTREAM MAX_BODY_SIZE")
+	}
+	// A body of exactly MAX_BODY_SIZE is accepted
+	_, err = downloadFile(path.Join(dir, "exact.png"), server.URL+"/exact.png", nil)
+	assert.NoError(t, err)
+	assert.FileExists(t, path.Join(dir, "exact.png"))
+	entries, err := os.ReadDir(dir)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 2, "nothing but sized.png and exact.png should be written")
+}
+
+func TestUpstreamHeader(t *testing.T) {
+	app := fiber.New()
+	var header http.Header
+	var private, authPrivate bool
+	options := config.MapOptions{
+		Headers:        map[string]string{"X-Origin-Key": "secret", "Authorization": "overridden"},
+		UserAgent:      "my-proxy/1.0",
+		BasicAuth:      "user:pass",
+		ForwardHeaders: []string{"Cookie", "X-Missing"},
+	}
+	app.Get("/*", func(c *fiber.Ctx) error {
+		header = upstreamHeader(options, c)
+		private = forwardsCredentials(options, c)
+		// Authorization of client is overridden by BASIC_AUTH
+		authPrivate = forwardsCredentials(config.MapOptions{BasicAuth: "user:pass", ForwardHeaders: []string{"authorization"}}, c)
+		return nil
+	})
+	req := httptest.NewRequest(http.MethodGet, "/tsuki.jpg", nil)
+	req.Header.Set("Cookie", "session=1")
+	req.Header.Set("Accept-Language", "en")
+	req.Header.Set("Authorization", "Bearer client")
+	_, err := app.Test(req)
+	assert.NoError(t, err)
+
+	assert.Equal(t, "session=1", header.Get("Cookie"))
+	assert.Equal(t, "secret", header.Get("X-Origin-Key"))
+	assert.Equal(t, "my-proxy/1.0", header.Get("User-Agent"))
+	assert.Equal(t, "Basic dXNlcjpwYXNz", header.Get("Authorization"))
+	assert.NotContains(t, header, "X-Missing")
+	assert.NotContains(t, header, "Accept-Language")
+	assert.True(t, private)
+	assert.False(t, authPrivate)
+
+	options.BearerToken = "token"
+	header = upstreamHeader(options, nil)
+	assert.Equal(t, "Bearer token", header.Get("Authorization"))
+	assert.Empty(t, header.Get("Cookie"))
+	assert.Equal(t, defaultUserAgent, upstreamHeader(config.MapOptions{}, nil).Get("User-Agent"))
+}
+
+func TestDownloadFileHeaders(t *testing.T) {
+	image, err := os.ReadFile("../pics/webp_server.png")
+	assert.NoError(t, err)
+	var userAgent string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		userAgent = r.UserAgent()
+		_, _ = w.Write(image)
+	}))
+	defer server.Close()
+	dir := t.TempDir()
+
+	_, err = downloadFile(path.Join(dir, "anonymous.png"), server.URL+"/auth.png", nil)
+	assert.Error(t, err)
+	assert.NoFileExists(t, path.Join(dir, "anonymous.png"))
+
+	header := upstreamHeader(config.MapOptions{BearerToken: "token"}, nil)
+	_, err = downloadFile(path.Join(dir, "auth.png"), server.URL+"/auth.png", header)
+	assert.NoError(t, err)
+	assert.FileExists(t, path.Join(dir, "auth.png"))
+	assert.Equal(t, defaultUserAgent, userAgent)
+}
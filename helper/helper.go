@@ -1,16 +1,20 @@
 package helper
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
 	_ "image/gif"
 	_ "image/jpeg"
 	_ "image/png"
 	"io"
+	"math"
+	"net/url"
 	"os"
 	"path"
 	"path/filepath"
+	"strconv"
 	"strings"
-	"time"
 	"webp_server_go/config"
 
 	_ "golang.org/x/image/webp"
@@ -75,37 +79,20 @@ func ImageExists(filename string) bool {
 		return false
 	}
 
-	// Check if there is lock in cache, retry after 1 second
-	maxRetries := 3
-	retryDelay := 100 * time.Millisecond // Initial retry delay
-
-	for range maxRetries {
-		if _, found := config.WriteLock.Get(filename); found {
-			log.Infof("file %s is locked, retrying in %s", filename, retryDelay)
-			time.Sleep(retryDelay)
-			retryDelay *= 2 // Exponential backoff
-			continue
-		}
-		f, err := os.Open(filename)
-		if err != nil {
-			return false
-		}
-		head := make([]byte, 512)
-		n, err := f.Read(head)
-		_ = f.Close()
-		if err != nil && err != io.EOF {
-			return false
-		}
-
-		kind, _ := filetype.Match(head[:n])
-
-		if kind != filetype.Unknown && strings.HasPrefix(kind.MIME.Value, "image/") {
-			return true
-		}
-
+	// Files are always complete since they are renamed into place by WriteFileAtomic
+	f, err := os.Open(filename)
+	if err != nil {
 		return false
 	}
-	return false
+	head := make([]byte, 512)
+	n, err := f.Read(head)
+	_ = f.Close()
+	if err != nil && err != io.EOF {
+		return false
+	}
+
+	kind, _ := filetype.Match(head[:n])
+	return kind != filetype.Unknown && strings.HasPrefix(kind.MIME.Value, "image/")
 }
 
 func GetImageExtension(filename string) string {
@@ -125,16 +112,145 @@ func CheckImageExtension(imgFilename string) bool {
 	return slices.Contains(config.DefaultAllowedTypes, GetImageExtension(imgFilename))
 }
 
+// SettingsFingerprint returns a hash of all settings that change encoded images.
+// It's part of exhaust file names, so images encoded with old settings are not served after a config change.
+func SettingsFingerprint() string {
+	settings, _ := json.Marshal(struct {
+		Version                    string
+		Quality                    int
+		WebpOptions                config.FormatOptions
+		AvifOptions                config.FormatOptions
+		JxlOptions                 config.FormatOptions
+		StripMetadata              bool
+		EnableExtraParams          bool
+		ExtraParamsCropInteresting string
+	}{
+		Version:                    config.Version,
+		Quality:                    config.Config.Quality,
+		WebpOptions:                config.Config.WebpOptions,
+		AvifOptions:                config.Config.AvifOptions,
+		JxlOptions:                 config.Config.JxlOptions,
+		StripMetadata:              config.Config.StripMetadata,
+		EnableExtraParams:          config.Config.EnableExtraParams,
+		ExtraParamsCropInteresting: config.Config.ExtraParamsCropInteresting,
+	})
+	return HashString(string(settings))
+}
+
+// GenOptimizedAbsPath returns exhaust paths of AVIF, WebP and JXL images, e.g. exhaust/local/<id>.<fingerprint>.webp
 func GenOptimizedAbsPath(metadata config.MetaFile, subdir string) (string, string, string) {
-	webpFilename := fmt.Sprintf("%s.webp", metadata.Id)
-	avifFilename := fmt.Sprintf("%s.avif", metadata.Id)
-	jxlFilename := fmt.Sprintf("%s.jxl", metadata.Id)
+	fingerprint := SettingsFingerprint()
+	webpFilename := fmt.Sprintf("%s.%s.webp", metadata.Id, fingerprint)
+	avifFilename := fmt.Sprintf("%s.%s.avif", metadata.Id, fingerprint)
+	jxlFilename := fmt.Sprintf("%s.%s.jxl", metadata.Id, fingerprint)
 	webpAbsolutePath := path.Clean(path.Join(config.Config.ExhaustPath, subdir, webpFilename))
 	avifAbsolutePath := path.Clean(path.Join(config.Config.ExhaustPath, subdir, avifFilename))
 	jxlAbsolutePath := path.Clean(path.Join(config.Config.ExhaustPath, subdir, jxlFilename))
 	return avifAbsolutePath, webpAbsolutePath, jxlAbsolutePath
 }
 
+// ParseExtraParams parses extra params from query, invalid values are ignored.
+// Both handler and cache keys in getId use it, so equivalent requests share the same cache.
+func ParseExtraParams(query url.Values) config.ExtraParams {
+	width, _ := strconv.Atoi(query.Get("width"))
+	height, _ := strconv.Atoi(query.Get("height"))
+	maxWidth, _ := strconv.Atoi(query.Get("max_width"))
+	maxHeight, _ := strconv.Atoi(query.Get("max_height"))
+	quality, _ := strconv.Atoi(query.Get("quality"))
+	// dpr multiplies all dimensions, so cache keys are built from effective dimensions
+	dpr, err := strconv.ParseFloat(query.Get("dpr"), 64)
+	if err != nil || dpr < 1 || dpr > 4 {
+		dpr = 1
+	}
+	format := strings.ToLower(query.Get("format"))
+	if !slices.Contains(config.OutputFormats, format) {
+		format = ""
+	}
+	fit := strings.ToLower(query.Get("fit"))
+	if !slices.Contains(config.FitModes, fit) {
+		fit = ""
+	}
+	gravity := strings.ToLower(query.Get("gravity"))
+	if gravity == "center" {
+		gravity = "centre"
+	}
+	if !slices.Contains(config.Gravities, gravity) {
+		gravity = ""
+	}
+	// fp_x and fp_y take precedence over gravity, a missing one defaults to the centre
+	focalX, focalY := 0.5, 0.5
+	if query.Has("fp_x") || query.Has("fp_y") {
+		x, xOk := parseFocal(query, "fp_x")
+		y, yOk := parseFocal(query, "fp_y")
+		if xOk && yOk {
+			gravity = "focalpoint"
+			focalX, focalY = x, y
+		}
+	}
+	if gravity != "focalpoint" {
+		focalX, focalY = 0, 0
+	}
+	return config.ExtraParams{
+		Width:      scaleDimension(width, dpr),
+		Height:     scaleDimension(height, dpr),
+		MaxWidth:   scaleDimension(maxWidth, dpr),
+		MaxHeight:  scaleDimension(maxHeight, dpr),
+		Dpr:        dpr,
+		Format:     format,
+		Quality:    ClampQuality(quality),
+		Fit:        fit,
+		Background: normalizeColor(query.Get("background")),
+		Gravity:    gravity,
+		FocalX:     focalX,
+		FocalY:     focalY,
+	}
+}
+
+// scaleDimension multiplies px by dpr, negative values are treated as unset(0)
+func scaleDimension(px int, dpr float64) int {
+	return int(math.Round(float64(max(px, 0)) * dpr))
+}
+
+// parseFocal returns the focal point coordinate of key in 0-1, 0.5 if it's missing, ok is false if it's invalid
+func parseFocal(query url.Values, key string) (float64, bool) {
+	if !query.Has(key) {
+		return 0.5, true
+	}
+	value, err := strconv.ParseFloat(query.Get(key), 64)
+	if err != nil || value < 0 || value > 1 {
+		return 0, false
+	}
+	return value, true
+}
+
+// normalizeColor returns lowercase RRGGBB or RRGGBBAA of a hex color like #fff, ffffff or ffffff80, "" if invalid
+func normalizeColor(color string) string {
+	color = strings.ToLower(strings.TrimPrefix(color, "#"))
+	if _, err := strconv.ParseUint(color, 16, 32); err != nil {
+		return ""
+	}
+	switch len(color) {
+	case 3:
+		return string([]byte{color[0], color[0], color[1], color[1], color[2], color[2]})
+	case 6, 8:
+		return color
+	}
+	return ""
+}
+
+// ClampQuality limits quality= extra param to MIN_QUALITY and MAX_QUALITY, 0 means unset and is kept as is
+func ClampQuality(quality int) int {
+	if quality <= 0 {
+		return 0
+	}
+	return max(config.Config.MinQuality, min(quality, config.Config.MaxQuality))
+}
+
+// GenResizedAbsPath returns exhaust path of images resized in their original format, e.g. exhaust/local/<id>.<fingerprint>
+func GenResizedAbsPath(metadata config.MetaFile, subdir string) string {
+	return path.Clean(path.Join(config.Config.ExhaustPath, subdir, metadata.Id+"."+SettingsFingerprint()))
+}
+
 func GetCompressionRate(RawImagePath string, optimizedImg string) string {
 	originFileInfo, err := os.Stat(RawImagePath)
 	if err != nil {
@@ -216,7 +332,36 @@ func CopyFile(src, dst string) error {
 	// Read all content of src to data
 	data, _ := os.ReadFile(src)
 	// Write data to dst
-	return os.WriteFile(dst, data, 0644)
+	return WriteFileAtomic(dst, data, 0644)
+}
+
+// WriteFileAtomic writes data to a temporary file in the same directory and renames it to filename,
+// so filename is either absent or complete, even if the process crashes while writing.
+func WriteFileAtomic(filename string, data []byte, perm os.FileMode) error {
+	return WriteReaderAtomic(filename, bytes.NewReader(data), perm)
+}
+
+// WriteReaderAtomic is WriteFileAtomic streaming from r, nothing is renamed into place if reading r fails
+func WriteReaderAtomic(filename string, r io.Reader, perm os.FileMode) error {
+	f, err := os.CreateTemp(path.Dir(filename), "."+path.Base(filename)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	tmpName := f.Name()
+	_, err = io.Copy(f, r)
+	if err == nil {
+		err = f.Chmod(perm)
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpName, filename)
+	}
+	if err != nil {
+		_ = os.Remove(tmpName)
+	}
+	return err
 }
 
 func FindSmallestFiles(files []string) string {
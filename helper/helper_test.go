@@ -1,6 +1,9 @@
 package helper
 
 import (
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"webp_server_go/config"
 
@@ -18,7 +21,7 @@ func TestMain(m *testing.M) {
 func TestFileCount(t *testing.T) {
 	// test helper dir
 	count := FileCount("./")
-	assert.Equal(t, int64(4), count)
+	assert.Equal(t, int64(6), count)
 }
 
 func TestImageExists(t *testing.T) {
@@ -26,8 +29,6 @@ func TestImageExists(t *testing.T) {
 		assert.False(t, ImageExists("dgyuaikdsa"))
 	})
 
-	// TODO: how to test lock?
-
 	t.Run("test dir", func(t *testing.T) {
 		assert.False(t, ImageExists("/tmp"))
 	})
@@ -53,6 +54,37 @@ func TestImageExists(t *testing.T) {
 	})
 }
 
+func TestWriteFileAtomic(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "8d8576343c4cb816.webp")
+
+	assert.NoError(t, WriteFileAtomic(filename, []byte("webp"), 0644))
+	assert.NoError(t, WriteFileAtomic(filename, []byte("webp2"), 0600))
+	data, err := os.ReadFile(filename)
+	assert.NoError(t, err)
+	assert.Equal(t, "webp2", string(data))
+	info, err := os.Stat(filename)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	// No temporary file is left behind
+	entries, err := os.ReadDir(dir)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 1)
+
+	assert.Error(t, WriteFileAtomic(filepath.Join(dir, "missing", "8d8576343c4cb816.webp"), []byte("webp"), 0644))
+}
+
+func TestGetFileContentType(t *testing.T) {
+	assert.Equal(t, "image/jpeg", GetFileContentType("../pics/webp_server.jpg"))
+
+	// SVG is only recognized with its closing tag, which can be far from the header
+	filename := filepath.Join(t.TempDir(), "large.svg")
+	paths := strings.Repeat(`<path d="M0 0L10 10"/>`, 1000)
+	assert.NoError(t, os.WriteFile(filename, []byte(`<svg xmlns="http://www.w3.org/2000/svg">`+paths+`</svg>`), 0644))
+	assert.Equal(t, "image/svg+xml", GetFileContentType(filename))
+}
+
 func TestCheckAllowedExtension(t *testing.T) {
 	t.Run("not allowed type", func(t *testing.T) {
 		assert.False(t, CheckAllowedExtension("./helper_test.go"))
@@ -63,6 +95,44 @@ func TestCheckAllowedExtension(t *testing.T) {
 	})
 }
 
+func TestGenOptimizedAbsPath(t *testing.T) {
+	metadata := config.MetaFile{Id: "8d8576343c4cb816"}
+	fingerprint := SettingsFingerprint()
+
+	avif, webp, jxl := GenOptimizedAbsPath(metadata, config.LocalHostAlias)
+	assert.Equal(t, "exhaust/local/8d8576343c4cb816."+fingerprint+".avif", avif)
+	assert.Equal(t, "exhaust/local/8d8576343c4cb816."+fingerprint+".webp", webp)
+	assert.Equal(t, "exhaust/local/8d8576343c4cb816."+fingerprint+".jxl", jxl)
+	assert.Equal(t, "exhaust/local/8d8576343c4cb816."+fingerprint, GenResizedAbsPath(metadata, config.LocalHostAlias))
+
+	// Changing encoder settings changes exhaust paths
+	config.Config.StripMetadata = !config.Config.StripMetadata
+	assert.NotEqual(t, fingerprint, SettingsFingerprint())
+	_, changedWebp, _ := GenOptimizedAbsPath(metadata, config.LocalHostAlias)
+	assert.NotEqual(t, webp, changedWebp)
+	config.Config.StripMetadata = !config.Config.StripMetadata
+
+	config.Config.WebpOptions.Effort = 4
+	assert.NotEqual(t, fingerprint, SettingsFingerprint())
+	config.Config.WebpOptions.Effort = 0
+	assert.Equal(t, fingerprint, SettingsFingerprint())
+}
+
+func TestClampQuality(t *testing.T) {
+	config.Config.MinQuality = 30
+	config.Config.MaxQuality = 90
+	defer func() {
+		config.Config.MinQuality = 1
+		config.Config.MaxQuality = 100
+	}()
+
+	assert.Equal(t, 0, ClampQuality(0))
+	assert.Equal(t, 0, ClampQuality(-5))
+	assert.Equal(t, 30, ClampQuality(10))
+	assert.Equal(t, 75, ClampQuality(75))
+	assert.Equal(t, 90, ClampQuality(100))
+}
+
 func TestGuessSupportedFormat(t *testing.T) {
 	tests := []struct {
 		name      string
@@ -0,0 +1,92 @@
+package helper
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"time"
+	"webp_server_go/config"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// lockPollInterval is how often a lock file held by another process is checked for release
+const lockPollInterval = 200 * time.Millisecond
+
+// lockFilePath returns the lock file of target, hidden so it's never matched as a cache file
+func lockFilePath(target string) string {
+	return path.Join(path.Dir(target), "."+path.Base(target)+".lock")
+}
+
+// LockCacheFile takes the lock file of target if SHARED_CACHE_LOCKS is enabled, returning its unlock.
+// Target should be checked for existence again once locked, it may have been written by the previous holder.
+func LockCacheFile(target string) (unlock func()) {
+	if !config.Config.SharedCacheLocks {
+		return func() {}
+	}
+	unlock, err := lockFile(target)
+	if err != nil {
+		log.Warnf("failed to lock %s, writing it without lock: %v", target, err)
+		return func() {}
+	}
+	return unlock
+}
+
+// lockFile blocks until the lock file of target is created by this process, so other processes sharing
+// the cache directory don't write target at the same time. The returned unlock removes the lock file.
+// A lock file not refreshed in LOCK_STALE_TIMEOUT is left by a crashed process and is taken over.
+func lockFile(target string) (unlock func(), err error) {
+	lockPath := lockFilePath(target)
+	if err := os.MkdirAll(path.Dir(lockPath), 0755); err != nil {
+		return nil, err
+	}
+	staleTimeout := time.Duration(config.Config.LockStaleTimeout) * time.Second
+	hostname, _ := os.Hostname()
+
+	for {
+		f, err := os.OpenFile(lockPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if err == nil {
+			// Owner is only written for debugging
+			_, _ = fmt.Fprintf(f, "%s:%d\n", hostname, os.Getpid())
+			_ = f.Close()
+			return holdLockFile(lockPath, staleTimeout), nil
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+		if info, err := os.Stat(lockPath); err == nil && time.Since(info.ModTime()) > staleTimeout {
+			// Two processes may both remove a stale lock and convert the same file once,
+			// which is harmless since cache files are renamed into place
+			log.Warnf("removing stale lock file %s", lockPath)
+			_ = os.Remove(lockPath)
+			continue
+		}
+		time.Sleep(lockPollInterval)
+	}
+}
+
+// holdLockFile refreshes mtime of lockPath until unlocked, so long conversions are not taken as stale
+func holdLockFile(lockPath string, staleTimeout time.Duration) func() {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(staleTimeout / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				now := time.Now()
+				if err := os.Chtimes(lockPath, now, now); err != nil {
+					log.Warnf("failed to refresh lock file %s: %v", lockPath, err)
+				}
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		if err := os.Remove(lockPath); err != nil {
+			log.Warnf("failed to remove lock file %s: %v", lockPath, err)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package helper
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+	"webp_server_go/config"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLockFile(t *testing.T) {
+	target := filepath.Join(t.TempDir(), "8d8576343c4cb816.webp")
+
+	unlock, err := lockFile(target)
+	assert.NoError(t, err)
+	assert.FileExists(t, lockFilePath(target))
+
+	locked := make(chan struct{})
+	go func() {
+		unlockSecond, err := lockFile(target)
+		assert.NoError(t, err)
+		close(locked)
+		unlockSecond()
+	}()
+	select {
+	case <-locked:
+		t.Fatal("lock file was taken twice")
+	case <-time.After(3 * lockPollInterval):
+	}
+
+	unlock()
+	select {
+	case <-locked:
+	case <-time.After(time.Second):
+		t.Fatal("lock file wasn't taken after unlock")
+	}
+	assert.Eventually(t, func() bool {
+		_, err := os.Stat(lockFilePath(target))
+		return os.IsNotExist(err)
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestLockFileStale(t *testing.T) {
+	target := filepath.Join(t.TempDir(), "8d8576343c4cb816.webp")
+	lockPath := lockFilePath(target)
+	assert.NoError(t, os.WriteFile(lockPath, []byte("crashed:1\n"), 0644))
+	old := time.Now().Add(-2 * time.Duration(config.Config.LockStaleTimeout) * time.Second)
+	assert.NoError(t, os.Chtimes(lockPath, old, old))
+
+	// Lock left by a crashed process is taken over
+	unlock, err := lockFile(target)
+	assert.NoError(t, err)
+	info, err := os.Stat(lockPath)
+	assert.NoError(t, err)
+	assert.WithinDuration(t, time.Now(), info.ModTime(), time.Minute)
+	unlock()
+}
+
+func TestLockCacheFile(t *testing.T) {
+	target := filepath.Join(t.TempDir(), "8d8576343c4cb816.webp")
+
+	// No lock file unless SHARED_CACHE_LOCKS is enabled
+	LockCacheFile(target)()
+	unlock := LockCacheFile(target)
+	assert.NoFileExists(t, lockFilePath(target))
+	unlock()
+
+	config.Config.SharedCacheLocks = true
+	defer func() { config.Config.SharedCacheLocks = false }()
+	unlock = LockCacheFile(target)
+	assert.FileExists(t, lockFilePath(target))
+	unlock()
+	assert.NoFileExists(t, lockFilePath(target))
+}
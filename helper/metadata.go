@@ -7,6 +7,7 @@ import (
 	"os"
 	"path"
 	"regexp"
+	"strconv"
 	"webp_server_go/config"
 
 	"github.com/buckket/go-blurhash"
@@ -23,37 +24,79 @@ func getId(p string, subdir string) (id string, filePath string, santizedPath st
 		return fileID, path.Join(config.Config.RemoteRawPath, subdir, fileID) + path.Ext(p), ""
 	}
 	parsed, _ := url.Parse(p)
-	width := parsed.Query().Get("width")
-	height := parsed.Query().Get("height")
-	max_width := parsed.Query().Get("max_width")
-	max_height := parsed.Query().Get("max_height")
+	extraParams := ParseExtraParams(parsed.Query())
 	// santizedPath will be /webp_server.jpg?width=200\u0026height=\u0026max_width=\u0026max_height= in local mode when requesting /webp_server.jpg?width=200
 	// santizedPath will be https://docs.webp.sh/images/webp_server.jpg?width=400 in proxy mode when requesting /images/webp_server.jpg?width=400 with IMG_PATH = https://docs.webp.sh
-	santizedPath = parsed.Path + "?width=" + width + "&height=" + height + "&max_width=" + max_width + "&max_height=" + max_height
+	santizedPath = parsed.Path + "?" + extraParamsKey(extraParams)
 	id = HashString(santizedPath)
 	filePath = path.Join(config.Config.ImgPath, parsed.Path)
 
 	return id, filePath, santizedPath
 }
 
+// extraParamsKey serializes effective extra params for cache keys, e.g. width=200&height=&max_width=&max_height=
+// Optional params are only appended when set, so cache keys of plain requests stay the same
+func extraParamsKey(extraParams config.ExtraParams) string {
+	key := "width=" + formatDimension(extraParams.Width) + "&height=" + formatDimension(extraParams.Height) +
+		"&max_width=" + formatDimension(extraParams.MaxWidth) + "&max_height=" + formatDimension(extraParams.MaxHeight)
+	if extraParams.Format != "" {
+		key += "&format=" + extraParams.Format
+	}
+	if extraParams.Quality > 0 {
+		key += "&quality=" + strconv.Itoa(extraParams.Quality)
+	}
+	if extraParams.Fit != "" {
+		key += "&fit=" + extraParams.Fit
+	}
+	if extraParams.Background != "" {
+		key += "&background=" + extraParams.Background
+	}
+	// Dimensions are already multiplied by dpr, so e.g. width=300&dpr=2 and width=600 share the key.
+	// Only a box larger than the source differs in output, dpr > 1 shrinks it to the source keeping its ratio.
+	if extraParams.Dpr > 1 && extraParams.Width > 0 && extraParams.Height > 0 {
+		key += "&capped=1"
+	}
+	if extraParams.Gravity == "focalpoint" {
+		key += "&fp_x=" + strconv.FormatFloat(extraParams.FocalX, 'f', -1, 64) + "&fp_y=" + strconv.FormatFloat(extraParams.FocalY, 'f', -1, 64)
+	} else if extraParams.Gravity != "" {
+		key += "&gravity=" + extraParams.Gravity
+	}
+	return key
+}
+
+// VariantId returns the id of extraParams variant of id, used when extra params are not part of the request URL
+func VariantId(id string, extraParams config.ExtraParams) string {
+	return id + "-" + HashString(extraParamsKey(extraParams))
+}
+
+// formatDimension returns "" for unset(0) dimensions
+func formatDimension(px int) string {
+	if px == 0 {
+		return ""
+	}
+	return strconv.Itoa(px)
+}
+
+// LoadMetadata reads metadata of p in METADATA_PATH/subdir, without rebuilding it if missing or corrupt
+func LoadMetadata(p string, subdir string) (config.MetaFile, error) {
+	var metadata config.MetaFile
+	var id, _, _ = getId(p, subdir)
+	buf, err := os.ReadFile(path.Join(config.Config.MetadataPath, subdir, id+".json"))
+	if err != nil {
+		return config.MetaFile{}, err
+	}
+	if err := json.Unmarshal(buf, &metadata); err != nil {
+		return config.MetaFile{}, err
+	}
+	return metadata, nil
+}
+
 func ReadMetadata(p, etag string, subdir string) (config.MetaFile, error) {
 	// Try to read metadata. If missing/corrupt, rebuild once.
-	var metadata config.MetaFile
 	var id, _, _ = getId(p, subdir)
 	metadataPath := path.Join(config.Config.MetadataPath, subdir, id+".json")
 
-	readAndUnmarshal := func() (config.MetaFile, error) {
-		buf, err := os.ReadFile(metadataPath)
-		if err != nil {
-			return config.MetaFile{}, err
-		}
-		if err := json.Unmarshal(buf, &metadata); err != nil {
-			return config.MetaFile{}, err
-		}
-		return metadata, nil
-	}
-
-	if data, err := readAndUnmarshal(); err == nil {
+	if data, err := LoadMetadata(p, subdir); err == nil {
 		return data, nil
 	} else {
 		log.Warnf("read metadata failed, rebuilding: %s", err)
@@ -64,7 +107,7 @@ func ReadMetadata(p, etag string, subdir string) (config.MetaFile, error) {
 	if err != nil {
 		return rebuilt, fmt.Errorf("failed to rebuild metadata at %s: %w", metadataPath, err)
 	}
-	data, err := readAndUnmarshal()
+	data, err := LoadMetadata(p, subdir)
 	if err != nil {
 		return config.MetaFile{}, fmt.Errorf("failed to read metadata at %s after rebuild: %w", metadataPath, err)
 	}
@@ -72,8 +115,32 @@ func ReadMetadata(p, etag string, subdir string) (config.MetaFile, error) {
 }
 
 func WriteMetadata(p, etag string, subdir string) (config.MetaFile, error) {
-	metadataDir := path.Join(config.Config.MetadataPath, subdir)
+	data := newMetadata(p, etag, subdir)
+	return data, SaveMetadata(data, subdir)
+}
 
+// NewRemoteMetadata builds metadata of remoteURL fetched into file, keeping validators of the upstream response
+// for conditional requests. Checksum is hash of etag, or of file if the upstream sent no ETag.
+func NewRemoteMetadata(remoteURL, file, etag, lastModified string) config.MetaFile {
+	var data = config.MetaFile{
+		Id:           HashString(remoteURL),
+		Path:         remoteURL,
+		ETag:         etag,
+		LastModified: lastModified,
+	}
+	if etag != "" {
+		data.Checksum = HashString(etag)
+	} else {
+		data.Checksum = HashFile(file)
+	}
+	if CheckImageExtension(file) {
+		data.ImageMeta = getImageMeta(file)
+	}
+	return data
+}
+
+// newMetadata builds metadata of p, checksum is hash of etag if given, otherwise of the file
+func newMetadata(p, etag string, subdir string) config.MetaFile {
 	var id, filepath, sant = getId(p, subdir)
 
 	var data = config.MetaFile{
@@ -93,21 +160,26 @@ func WriteMetadata(p, etag string, subdir string) (config.MetaFile, error) {
 		imageMeta := getImageMeta(filepath)
 		data.ImageMeta = imageMeta
 	}
+	return data
+}
 
+// SaveMetadata writes data into METADATA_PATH/subdir
+func SaveMetadata(data config.MetaFile, subdir string) error {
+	metadataDir := path.Join(config.Config.MetadataPath, subdir)
 	if err := os.MkdirAll(metadataDir, 0755); err != nil {
-		return data, fmt.Errorf("create metadata dir %s: %w", metadataDir, err)
+		return fmt.Errorf("create metadata dir %s: %w", metadataDir, err)
 	}
 
 	buf, err := json.Marshal(data)
 	if err != nil {
-		return data, fmt.Errorf("marshal metadata %s: %w", data.Id, err)
+		return fmt.Errorf("marshal metadata %s: %w", data.Id, err)
 	}
 
-	metadataPath := path.Join(config.Config.MetadataPath, subdir, data.Id+".json")
-	if err := os.WriteFile(metadataPath, buf, 0644); err != nil {
-		return data, fmt.Errorf("write metadata file %s: %w", metadataPath, err)
+	metadataPath := path.Join(metadataDir, data.Id+".json")
+	if err := WriteFileAtomic(metadataPath, buf, 0644); err != nil {
+		return fmt.Errorf("write metadata file %s: %w", metadataPath, err)
 	}
-	return data, nil
+	return nil
 }
 
 func getImageMeta(filePath string) (metadata config.ImageMeta) {
@@ -208,3 +280,30 @@ func DeleteMetadata(p string, subdir string) {
 		log.Warnln("failed to delete metadata", err)
 	}
 }
+
+// ListMetadata returns all metadata in METADATA_PATH/subdir, unreadable files are skipped
+func ListMetadata(subdir string) ([]config.MetaFile, error) {
+	metadataDir := path.Join(config.Config.MetadataPath, subdir)
+	entries, err := os.ReadDir(metadataDir)
+	if err != nil {
+		return nil, err
+	}
+	var metadatas []config.MetaFile
+	for _, entry := range entries {
+		if entry.IsDir() || path.Ext(entry.Name()) != ".json" {
+			continue
+		}
+		buf, err := os.ReadFile(path.Join(metadataDir, entry.Name()))
+		if err != nil {
+			log.Warnf("failed to read metadata %s: %s", entry.Name(), err)
+			continue
+		}
+		var metadata config.MetaFile
+		if err := json.Unmarshal(buf, &metadata); err != nil {
+			log.Warnf("failed to parse metadata %s: %s", entry.Name(), err)
+			continue
+		}
+		metadatas = append(metadatas, metadata)
+	}
+	return metadatas, nil
+}
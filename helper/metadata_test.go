@@ -8,6 +8,8 @@ import (
 	"strings"
 	"testing"
 	"webp_server_go/config"
+
+	"github.com/stretchr/testify/assert"
 )
 
 func TestGetId(t *testing.T) {
@@ -43,6 +45,84 @@ func TestGetId(t *testing.T) {
 				expectedId, expectedPath, expectedSantizedPath, id, jointPath, santizedPath)
 		}
 	})
+	t.Run("local path with format", func(t *testing.T) {
+		plainId, _, _ := getId("/image.jpg?width=400", "")
+		avifId, _, santizedPath := getId("/image.jpg?width=400&format=AVIF", "")
+		invalidId, _, _ := getId("/image.jpg?width=400&format=gif", "")
+
+		assert.Equal(t, "/image.jpg?width=400&height=&max_width=&max_height=&format=avif", santizedPath)
+		assert.NotEqual(t, plainId, avifId)
+		assert.Equal(t, plainId, invalidId)
+	})
+	t.Run("local path with quality", func(t *testing.T) {
+		config.Config.MaxQuality = 90
+		defer func() { config.Config.MaxQuality = 100 }()
+
+		plainId, _, _ := getId("/image.jpg?width=400", "")
+		qualityId, _, santizedPath := getId("/image.jpg?width=400&quality=95", "")
+		clampedId, _, _ := getId("/image.jpg?width=400&quality=90", "")
+		invalidId, _, _ := getId("/image.jpg?width=400&quality=abc", "")
+
+		assert.Equal(t, "/image.jpg?width=400&height=&max_width=&max_height=&quality=90", santizedPath)
+		assert.NotEqual(t, plainId, qualityId)
+		assert.Equal(t, qualityId, clampedId)
+		assert.Equal(t, plainId, invalidId)
+	})
+	t.Run("local path with fit and background", func(t *testing.T) {
+		plainId, _, _ := getId("/image.jpg?width=400&height=300", "")
+		containId, _, santizedPath := getId("/image.jpg?width=400&height=300&fit=Contain&background=%23FFF", "")
+		sameId, _, _ := getId("/image.jpg?width=400&height=300&fit=contain&background=ffffff", "")
+		invalidId, _, _ := getId("/image.jpg?width=400&height=300&fit=zoom&background=white", "")
+
+		assert.Equal(t, "/image.jpg?width=400&height=300&max_width=&max_height=&fit=contain&background=ffffff", santizedPath)
+		assert.NotEqual(t, plainId, containId)
+		assert.Equal(t, containId, sameId)
+		assert.Equal(t, plainId, invalidId)
+	})
+	t.Run("local path with gravity and focal point", func(t *testing.T) {
+		plainId, _, _ := getId("/image.jpg?width=400&height=300", "")
+		_, _, santizedPath := getId("/image.jpg?width=400&height=300&gravity=Center", "")
+		assert.Equal(t, "/image.jpg?width=400&height=300&max_width=&max_height=&gravity=centre", santizedPath)
+
+		focalId, _, santizedPath := getId("/image.jpg?width=400&height=300&gravity=north&fp_x=0.25", "")
+		assert.Equal(t, "/image.jpg?width=400&height=300&max_width=&max_height=&fp_x=0.25&fp_y=0.5", santizedPath)
+		assert.NotEqual(t, plainId, focalId)
+
+		invalidId, _, _ := getId("/image.jpg?width=400&height=300&gravity=up&fp_x=2", "")
+		assert.Equal(t, plainId, invalidId)
+	})
+	t.Run("local path with dpr", func(t *testing.T) {
+		_, _, santizedPath := getId("/image.jpg?width=200&max_height=150&dpr=2", "")
+		assert.Equal(t, "/image.jpg?width=400&height=&max_width=&max_height=300", santizedPath)
+
+		scaledId, _, _ := getId("/image.jpg?width=300&dpr=2", "")
+		effectiveId, _, _ := getId("/image.jpg?width=600", "")
+		assert.Equal(t, effectiveId, scaledId)
+
+		_, _, santizedPath = getId("/image.jpg?width=300&height=200&dpr=2", "")
+		assert.Equal(t, "/image.jpg?width=600&height=400&max_width=&max_height=&capped=1", santizedPath)
+		cappedId, _, _ := getId("/image.jpg?width=300&height=300&dpr=2", "")
+		scaledId, _, _ = getId("/image.jpg?width=200&height=200&dpr=3", "")
+		assert.Equal(t, cappedId, scaledId)
+		// Without dpr a box larger than the source leaves it untouched instead
+		boxId, _, _ := getId("/image.jpg?width=600&height=600", "")
+		assert.NotEqual(t, boxId, cappedId)
+
+		plainId, _, _ := getId("/image.jpg?width=200", "")
+		oneId, _, _ := getId("/image.jpg?width=200&dpr=1", "")
+		invalidId, _, _ := getId("/image.jpg?width=200&dpr=5", "")
+		assert.Equal(t, plainId, oneId)
+		assert.Equal(t, plainId, invalidId)
+	})
+}
+
+func TestVariantId(t *testing.T) {
+	plain := VariantId("8d8576343c4cb816", config.ExtraParams{})
+	resized := VariantId("8d8576343c4cb816", config.ExtraParams{Width: 200})
+
+	assert.Equal(t, "8d8576343c4cb816-"+HashString("width=&height=&max_width=&max_height="), plain)
+	assert.NotEqual(t, plain, resized)
+	assert.Equal(t, resized, VariantId("8d8576343c4cb816", config.ExtraParams{Width: 200}))
 }
 
 func TestWriteAndReadMetadataSuccess(t *testing.T) {
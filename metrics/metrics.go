@@ -0,0 +1,128 @@
+package metrics
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/adaptor"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "webp_server"
+
+var (
+	requests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "requests_total",
+		Help:      "Image requests by response status and served format.",
+	}, []string{"status", "format"})
+
+	exhaustCache = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "exhaust_cache_total",
+		Help:      "Image requests served from exhaust files (hit) or needing conversion (miss).",
+	}, []string{"result"})
+
+	conversionDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "conversion_duration_seconds",
+		Help:      "Time spent encoding images by encoder.",
+		Buckets:   []float64{.01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30},
+	}, []string{"encoder"})
+
+	remoteFetchDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "remote_fetch_duration_seconds",
+		Help:      "Latency of requests to remote backends by HTTP method.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method"})
+
+	remoteFetchErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "remote_fetch_errors_total",
+		Help:      "Failed requests to remote backends by HTTP method, including non-200 responses.",
+	}, []string{"method"})
+
+	bytesSaved = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "bytes_saved_total",
+		Help:      "Bytes saved by serving optimized images instead of source images.",
+	})
+
+	cacheSize = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "cache_size_bytes",
+		Help:      "Size of cache directories after the last MAX_CACHE_SIZE enforcement.",
+	}, []string{"path"})
+
+	conversionsInProgress = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "conversions_in_progress",
+		Help:      "Output files currently under conversion.",
+	})
+)
+
+// Handler serves metrics in Prometheus text format
+var Handler = adaptor.HTTPHandler(promhttp.Handler())
+
+// Instrument counts requests by status and the format in response Content-Type, e.g. image/webp -> webp
+func Instrument(c *fiber.Ctx) error {
+	err := c.Next()
+	status := c.Response().StatusCode()
+	if err != nil {
+		// Errors are turned into responses by the error handler after this returns
+		status = fiber.StatusInternalServerError
+		if e, ok := err.(*fiber.Error); ok {
+			status = e.Code
+		}
+	}
+	format := "none"
+	if contentType := string(c.Response().Header.ContentType()); strings.HasPrefix(contentType, "image/") {
+		format = strings.TrimPrefix(contentType, "image/")
+	}
+	requests.WithLabelValues(strconv.Itoa(status), format).Inc()
+	return err
+}
+
+// ExhaustCache records whether the image of a request was already in exhaust
+func ExhaustCache(hit bool) {
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+	exhaustCache.WithLabelValues(result).Inc()
+}
+
+// ObserveConversion records time spent by encoder since start
+func ObserveConversion(encoder string, start time.Time) {
+	conversionDuration.WithLabelValues(encoder).Observe(time.Since(start).Seconds())
+}
+
+// ObserveRemoteFetch records latency of a request to remote backend since start, and whether it failed
+func ObserveRemoteFetch(method string, start time.Time, failed bool) {
+	remoteFetchDuration.WithLabelValues(method).Observe(time.Since(start).Seconds())
+	if failed {
+		remoteFetchErrors.WithLabelValues(method).Inc()
+	}
+}
+
+// AddBytesSaved records the difference between source and served image size, if any was saved
+func AddBytesSaved(rawSize, servedSize int64) {
+	if rawSize > servedSize {
+		bytesSaved.Add(float64(rawSize - servedSize))
+	}
+}
+
+// SetCacheSize records the size of cache directory p
+func SetCacheSize(p string, size int64) {
+	cacheSize.WithLabelValues(p).Set(float64(size))
+}
+
+// SetConversionsInProgress records the number of output files under conversion
+func SetConversionsInProgress(n int) {
+	conversionsInProgress.Set(float64(n))
+}
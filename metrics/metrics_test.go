@@ -0,0 +1,64 @@
+package metrics
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInstrument(t *testing.T) {
+	app := fiber.New()
+	app.Get("/metrics", Handler)
+	app.Get("/*", Instrument, func(c *fiber.Ctx) error {
+		if c.Path() == "/missing.jpg" {
+			return c.SendStatus(http.StatusNotFound)
+		}
+		c.Set(fiber.HeaderContentType, "image/webp")
+		return c.SendString("webp")
+	})
+
+	for _, p := range []string{"/tsuki.jpg", "/tsuki.jpg", "/missing.jpg"} {
+		resp, err := app.Test(httptest.NewRequest(http.MethodGet, p, nil))
+		assert.NoError(t, err)
+		_ = resp.Body.Close()
+	}
+	assert.Equal(t, float64(2), testutil.ToFloat64(requests.WithLabelValues("200", "webp")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(requests.WithLabelValues("404", "none")))
+
+	resp, err := app.Test(httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	assert.NoError(t, err)
+	body, _ := io.ReadAll(resp.Body)
+	assert.True(t, strings.Contains(string(body), `webp_server_requests_total{format="webp",status="200"} 2`))
+	assert.True(t, strings.Contains(string(body), "webp_server_conversions_in_progress 0"))
+}
+
+func TestRecorders(t *testing.T) {
+	ExhaustCache(true)
+	ExhaustCache(false)
+	ExhaustCache(false)
+	assert.Equal(t, float64(1), testutil.ToFloat64(exhaustCache.WithLabelValues("hit")))
+	assert.Equal(t, float64(2), testutil.ToFloat64(exhaustCache.WithLabelValues("miss")))
+
+	AddBytesSaved(1000, 400)
+	AddBytesSaved(400, 1000)
+	assert.Equal(t, float64(600), testutil.ToFloat64(bytesSaved))
+
+	ObserveRemoteFetch(http.MethodHead, time.Now(), false)
+	ObserveRemoteFetch(http.MethodGet, time.Now(), true)
+	assert.Equal(t, float64(0), testutil.ToFloat64(remoteFetchErrors.WithLabelValues(http.MethodHead)))
+	assert.Equal(t, float64(1), testutil.ToFloat64(remoteFetchErrors.WithLabelValues(http.MethodGet)))
+	assert.Equal(t, 2, testutil.CollectAndCount(remoteFetchDuration))
+
+	ObserveConversion("webp", time.Now())
+	assert.Equal(t, 1, testutil.CollectAndCount(conversionDuration))
+
+	SetCacheSize("./exhaust", 1024)
+	assert.Equal(t, float64(1024), testutil.ToFloat64(cacheSize.WithLabelValues("./exhaust")))
+}
@@ -1,11 +1,16 @@
 package schedule
 
 import (
+	"context"
 	"os"
 	"path/filepath"
+	"regexp"
 	"sort"
+	"strings"
 	"time"
 	"webp_server_go/config"
+	"webp_server_go/helper"
+	"webp_server_go/metrics"
 
 	log "github.com/sirupsen/logrus"
 )
@@ -70,22 +75,22 @@ func listFiles(path string) ([]fileInfo, error) {
 }
 
 // removeOldest removes files from the directory in ascending mod-time order
-// until the total size is <= maxCacheSizeBytes.
-func removeOldest(dir string, maxCacheSizeBytes int64) error {
+// until the total size is <= maxCacheSizeBytes, returning the size left.
+func removeOldest(dir string, maxCacheSizeBytes int64) (int64, error) {
 	dirSize, err := getDirSize(dir)
 	if err != nil {
-		return err
+		return dirSize, err
 	}
 	if dirSize <= maxCacheSizeBytes {
-		return nil
+		return dirSize, nil
 	}
 
 	files, err := listFiles(dir)
 	if err != nil {
-		return err
+		return dirSize, err
 	}
 	if len(files) == 0 {
-		return nil
+		return dirSize, nil
 	}
 
 	// sort by modification time ascending (oldest first)
@@ -105,12 +110,12 @@ func removeOldest(dir string, maxCacheSizeBytes int64) error {
 		dirSize -= f.size
 		log.Infof("deleted cached file: %s", f.path)
 	}
-	return nil
+	return dirSize, nil
 }
 
 // CleanCache periodically enforces MaxCacheSize on configured cache paths.
-// Runs until the process exits.
-func CleanCache() {
+// Runs until ctx is done.
+func CleanCache(ctx context.Context) {
 	if config.Config.MaxCacheSize == 0 {
 		return
 	}
@@ -118,7 +123,13 @@ func CleanCache() {
 	ticker := time.NewTicker(1 * time.Minute)
 	defer ticker.Stop()
 
-	for range ticker.C {
+	for {
+		select {
+		case <-ctx.Done():
+			log.Info("stopping cache cleaning service")
+			return
+		case <-ticker.C:
+		}
 		maxBytes := int64(config.Config.MaxCacheSize) * 1024 * 1024
 		paths := []string{
 			config.Config.RemoteRawPath,
@@ -126,24 +137,65 @@ func CleanCache() {
 			config.Config.MetadataPath,
 		}
 		for _, p := range paths {
-			if err := removeOldest(p, maxBytes); err != nil {
+			size, err := removeOldest(p, maxBytes)
+			if err != nil {
 				// ignore not-exist errors, warn on others
 				if !os.IsNotExist(err) {
 					log.Warnf("failed to clear cache at %s: %v", p, err)
 				}
+				continue
 			}
+			metrics.SetCacheSize(p, size)
 		}
 	}
 }
 
-// DeleteDeadCache removes stale temporary vips-* directories older than threshold.
-func DeleteDeadCache() {
+// tempFileRegexp matches temp files of helper.WriteReaderAtomic: .<name>.<random>.tmp
+var tempFileRegexp = regexp.MustCompile(`^\..+\.[0-9]+\.tmp$`)
+
+// tempFileMaxAge is how long a temp file may be written to, older ones were left by a crash or kill
+const tempFileMaxAge = time.Hour
+
+// deleteStaleTempFiles removes temp files under dir last modified before threshold, returning how many were removed.
+func deleteStaleTempFiles(dir string, threshold time.Time) int {
+	var count int
+	_ = filepath.WalkDir(dir, func(p string, d os.DirEntry, err error) error {
+		if err != nil || d.IsDir() || !tempFileRegexp.MatchString(d.Name()) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil || !info.ModTime().Before(threshold) {
+			return nil
+		}
+		if err := os.Remove(p); err != nil {
+			log.Warnf("failed to delete stale temp file %s: %v", p, err)
+			return nil
+		}
+		count++
+		return nil
+	})
+	return count
+}
+
+// DeleteDeadCache removes stale temporary vips-* directories older than threshold, and temp files of interrupted
+// writes to EXHAUST_PATH, METADATA_PATH and REMOTE_RAW_PATH, until ctx is done.
+func DeleteDeadCache(ctx context.Context) {
 	ticker := time.NewTicker(30 * time.Second)
 	defer ticker.Stop()
 	threshold := time.Now().Add(-10 * time.Minute)
 	tempBase := filepath.Join(os.TempDir(), "vips-")
 
-	for range ticker.C {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		for _, dir := range []string{config.Config.ExhaustPath, config.Config.MetadataPath, config.Config.RemoteRawPath} {
+			if count := deleteStaleTempFiles(dir, time.Now().Add(-tempFileMaxAge)); count > 0 {
+				log.Warnf("deleted %d stale temp files in %s", count, dir)
+			}
+		}
 		_ = filepath.WalkDir(tempBase, func(p string, d os.DirEntry, err error) error {
 			if err != nil {
 				return nil
@@ -163,3 +215,49 @@ func DeleteDeadCache() {
 		})
 	}
 }
+
+// exhaustFileRegexp matches file names written to EXHAUST_PATH: <id>[-<variant>][.<fingerprint>][.webp|.avif|.jxl]
+var exhaustFileRegexp = regexp.MustCompile(`^[0-9a-f]{1,16}(-[0-9a-f]{1,16})?(\.[0-9a-f]{1,16})?(\.(webp|avif|jxl))?$`)
+
+// isStaleExhaustFile reports whether name was written by an older generation of encoder settings.
+func isStaleExhaustFile(name string, fingerprint string) bool {
+	if !exhaustFileRegexp.MatchString(name) {
+		// Not written by us, leave it alone
+		return false
+	}
+	parts := strings.Split(name, ".")
+	return len(parts) < 2 || parts[1] != fingerprint
+}
+
+// DeleteStaleExhaust removes exhaust files encoded with settings other than the current ones,
+// these would never be served again since the settings fingerprint is part of exhaust file names.
+// With SHARED_CACHE_LOCKS, EXHAUST_PATH is shared with processes that may run other settings, e.g. during a rolling
+// update, so nothing is removed and old files are left to MAX_CACHE_SIZE. The walk is abandoned once ctx is done.
+func DeleteStaleExhaust(ctx context.Context) {
+	if config.Config.SharedCacheLocks {
+		log.Info("SHARED_CACHE_LOCKS is on, leaving exhaust files of other settings in place")
+		return
+	}
+	fingerprint := helper.SettingsFingerprint()
+	var count int
+	_ = filepath.WalkDir(config.Config.ExhaustPath, func(p string, d os.DirEntry, err error) error {
+		if ctx.Err() != nil {
+			return filepath.SkipAll
+		}
+		if err != nil {
+			return nil
+		}
+		if d.IsDir() || !isStaleExhaustFile(d.Name(), fingerprint) {
+			return nil
+		}
+		if err := os.Remove(p); err != nil {
+			log.Warnf("failed to delete stale exhaust file %s: %v", p, err)
+			return nil
+		}
+		count++
+		return nil
+	})
+	if count > 0 {
+		log.Infof("deleted %d exhaust files encoded with old settings", count)
+	}
+}
@@ -0,0 +1,110 @@
+package schedule
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+	"webp_server_go/config"
+	"webp_server_go/helper"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsStaleExhaustFile(t *testing.T) {
+	fingerprint := "1a2b3c4d5e6f7a8b"
+
+	assert.False(t, isStaleExhaustFile("8d8576343c4cb816."+fingerprint+".webp", fingerprint))
+	assert.False(t, isStaleExhaustFile("8d8576343c4cb816."+fingerprint, fingerprint))
+	assert.False(t, isStaleExhaustFile("8d8576343c4cb816-0123456789abcdef."+fingerprint+".avif", fingerprint))
+	assert.True(t, isStaleExhaustFile("8d8576343c4cb816-0123456789abcdef.ffffffffffffffff.avif", fingerprint))
+	// Written before fingerprints were added
+	assert.True(t, isStaleExhaustFile("8d8576343c4cb816.webp", fingerprint))
+	assert.True(t, isStaleExhaustFile("8d8576343c4cb816", fingerprint))
+	// Written with other settings
+	assert.True(t, isStaleExhaustFile("8d8576343c4cb816.ffffffffffffffff.avif", fingerprint))
+	// Not written by WebP Server Go
+	assert.False(t, isStaleExhaustFile("tsuki.jpg", fingerprint))
+	assert.False(t, isStaleExhaustFile(".gitkeep", fingerprint))
+}
+
+func TestDeleteStaleExhaust(t *testing.T) {
+	config.Config.ExhaustPath = t.TempDir()
+	fingerprint := helper.SettingsFingerprint()
+
+	files := map[string]bool{
+		"local/8d8576343c4cb816." + fingerprint + ".webp": true,
+		"local/8d8576343c4cb816.webp":                     false,
+		"example.com/8d8576343c4cb816.0000000000000000":   false,
+		"local/readme.txt":                                true,
+	}
+	for name := range files {
+		p := filepath.Join(config.Config.ExhaustPath, name)
+		assert.NoError(t, os.MkdirAll(filepath.Dir(p), 0755))
+		assert.NoError(t, os.WriteFile(p, []byte("x"), 0600))
+	}
+
+	// Files of other processes sharing EXHAUST_PATH are kept
+	config.Config.SharedCacheLocks = true
+	DeleteStaleExhaust(context.Background())
+	config.Config.SharedCacheLocks = false
+	for name := range files {
+		assert.FileExists(t, filepath.Join(config.Config.ExhaustPath, name))
+	}
+
+	DeleteStaleExhaust(context.Background())
+
+	for name, kept := range files {
+		_, err := os.Stat(filepath.Join(config.Config.ExhaustPath, name))
+		assert.Equal(t, kept, err == nil, name)
+	}
+}
+
+func TestDeleteStaleTempFiles(t *testing.T) {
+	dir := t.TempDir()
+	old := time.Now().Add(-2 * tempFileMaxAge)
+
+	files := map[string]bool{
+		"local/.8d8576343c4cb816.webp.123456.tmp": false,
+		"local/.8d8576343c4cb816.json.42.tmp":     false,
+		"local/8d8576343c4cb816.webp":             true,
+		"local/notes.tmp":                         true,
+	}
+	for name := range files {
+		p := filepath.Join(dir, name)
+		assert.NoError(t, os.MkdirAll(filepath.Dir(p), 0755))
+		assert.NoError(t, os.WriteFile(p, []byte("x"), 0600))
+		assert.NoError(t, os.Chtimes(p, old, old))
+	}
+	// Still being written
+	recent := filepath.Join(dir, "local/.0123456789abcdef.png.7.tmp")
+	assert.NoError(t, os.WriteFile(recent, []byte("x"), 0600))
+	files["local/.0123456789abcdef.png.7.tmp"] = true
+
+	assert.Equal(t, 2, deleteStaleTempFiles(dir, time.Now().Add(-tempFileMaxAge)))
+
+	for name, kept := range files {
+		_, err := os.Stat(filepath.Join(dir, name))
+		assert.Equal(t, kept, err == nil, name)
+	}
+}
+
+func TestScheduleStopsOnCancel(t *testing.T) {
+	config.Config.MaxCacheSize = 1
+	defer func() { config.Config.MaxCacheSize = 0 }()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	done := make(chan struct{})
+	go func() {
+		CleanCache(ctx)
+		DeleteDeadCache(ctx)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("schedule goroutines didn't stop after cancel")
+	}
+}
@@ -0,0 +1,50 @@
+package signature
+
+import (
+	"net/url"
+	"strings"
+)
+
+// PathParamsPrefix starts a path segment of extra params, e.g. /_/w_300,h_200/tsuki.jpg
+const PathParamsPrefix = "/_/"
+
+// pathParamNames maps short option names in path segment to query params
+var pathParamNames = map[string]string{
+	"w":   "width",
+	"h":   "height",
+	"mw":  "max_width",
+	"mh":  "max_height",
+	"q":   "quality",
+	"f":   "format",
+	"fit": "fit",
+	"bg":  "background",
+	"g":   "gravity",
+	"fpx": "fp_x",
+	"fpy": "fp_y",
+	"dpr": "dpr",
+	"p":   "preset",
+}
+
+// SplitPathParams parses the extra params segment of escaped reqPath, returning the params and reqPath without
+// the segment. Unknown options are ignored. ok is false if reqPath doesn't start with the segment.
+// Path params are signed as if they were query params of the path without the segment.
+func SplitPathParams(reqPath string) (params url.Values, rest string, ok bool) {
+	segment, rest, found := strings.Cut(strings.TrimPrefix(reqPath, PathParamsPrefix), "/")
+	if !strings.HasPrefix(reqPath, PathParamsPrefix) || !found {
+		return nil, reqPath, false
+	}
+	params = url.Values{}
+	for option := range strings.SplitSeq(segment, ",") {
+		name, value, _ := strings.Cut(option, "_")
+		key, known := pathParamNames[name]
+		if !known {
+			continue
+		}
+		value, err := url.PathUnescape(value)
+		if err != nil {
+			continue
+		}
+		params.Set(key, value)
+	}
+	return params, "/" + rest, true
+}
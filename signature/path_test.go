@@ -0,0 +1,24 @@
+package signature
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSplitPathParams(t *testing.T) {
+	params, rest, ok := SplitPathParams("/_/w_300,h_200,fit_contain,bg_%23fff,fpx_0.3,p_thumb,zoom_2/images/tsuki.jpg")
+	assert.True(t, ok)
+	assert.Equal(t, "/images/tsuki.jpg", rest)
+	assert.Equal(t, "background=%23fff&fit=contain&fp_x=0.3&height=200&preset=thumb&width=300", params.Encode())
+
+	params, rest, ok = SplitPathParams("/images/tsuki.jpg")
+	assert.False(t, ok)
+	assert.Nil(t, params)
+	assert.Equal(t, "/images/tsuki.jpg", rest)
+
+	// Segment without file path
+	_, rest, ok = SplitPathParams("/_/w_300")
+	assert.False(t, ok)
+	assert.Equal(t, "/_/w_300", rest)
+}
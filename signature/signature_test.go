@@ -0,0 +1,108 @@
+package signature
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const secret = "s3cr3t"
+
+func parse(t *testing.T, rawURL string) (string, url.Values) {
+	t.Helper()
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		t.Fatalf("failed to parse %s: %v", rawURL, err)
+	}
+	return u.Path, u.Query()
+}
+
+func TestSignURLRoundTrip(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+
+	t.Run("without expiry", func(t *testing.T) {
+		signed, err := SignURL(secret, "/path/tsuki.jpg?width=200&height=100", time.Time{})
+		assert.NoError(t, err)
+		p, query := parse(t, signed)
+		assert.Equal(t, "", query.Get(ExpiresParam))
+		assert.NoError(t, Verify(secret, p, query, now))
+	})
+
+	t.Run("parameter order does not matter", func(t *testing.T) {
+		signed, _ := SignURL(secret, "/tsuki.jpg?width=200&height=100", time.Time{})
+		_, query := parse(t, signed)
+		reordered, _ := url.ParseQuery("height=100&sig=" + query.Get(SigParam) + "&width=200")
+		assert.NoError(t, Verify(secret, "/tsuki.jpg", reordered, now))
+	})
+
+	t.Run("unicode path", func(t *testing.T) {
+		signed, _ := SignURL(secret, "/%e5%a4%aa%e7%a5%9e%e5%95%a6.png?width=200", time.Time{})
+		_, query := parse(t, signed)
+		assert.NoError(t, Verify(secret, "/太神啦.png", query, now))
+	})
+
+	t.Run("path params", func(t *testing.T) {
+		signed, err := SignURL(secret, "/_/w_200,bg_%23fff/images/tsuki.jpg?v=2", now.Add(time.Minute))
+		assert.NoError(t, err)
+		u, _ := url.Parse(signed)
+		assert.Equal(t, "/_/w_200,bg_%23fff/images/tsuki.jpg", u.EscapedPath())
+		assert.False(t, u.Query().Has("width"))
+
+		// Verified the way the server does, against the path without the segment
+		params, rest, ok := SplitPathParams(u.EscapedPath())
+		assert.True(t, ok)
+		query := u.Query()
+		for key, values := range params {
+			query[key] = values
+		}
+		assert.NoError(t, Verify(secret, rest, query, now))
+		query.Set("width", "300")
+		assert.ErrorIs(t, Verify(secret, rest, query, now), ErrInvalid)
+	})
+
+	t.Run("expiry", func(t *testing.T) {
+		signed, _ := SignURL(secret, "/tsuki.jpg?width=200", now.Add(time.Minute))
+		p, query := parse(t, signed)
+		assert.NoError(t, Verify(secret, p, query, now))
+		assert.ErrorIs(t, Verify(secret, p, query, now.Add(2*time.Minute)), ErrExpired)
+	})
+}
+
+func TestVerifyRejectsTampering(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	signed, _ := SignURL(secret, "/tsuki.jpg?width=200", now.Add(time.Minute))
+	p, query := parse(t, signed)
+
+	t.Run("missing signature", func(t *testing.T) {
+		unsigned, _ := url.ParseQuery("width=200")
+		assert.ErrorIs(t, Verify(secret, p, unsigned, now), ErrMissing)
+	})
+
+	t.Run("changed parameter", func(t *testing.T) {
+		tampered := url.Values{}
+		for k, v := range query {
+			tampered[k] = v
+		}
+		tampered.Set("width", "201")
+		assert.ErrorIs(t, Verify(secret, p, tampered, now), ErrInvalid)
+	})
+
+	t.Run("added parameter", func(t *testing.T) {
+		tampered := url.Values{}
+		for k, v := range query {
+			tampered[k] = v
+		}
+		tampered.Set("height", "100")
+		assert.ErrorIs(t, Verify(secret, p, tampered, now), ErrInvalid)
+	})
+
+	t.Run("changed path", func(t *testing.T) {
+		assert.ErrorIs(t, Verify(secret, "/other.jpg", query, now), ErrInvalid)
+	})
+
+	t.Run("wrong secret", func(t *testing.T) {
+		assert.ErrorIs(t, Verify("another", p, query, now), ErrInvalid)
+	})
+}
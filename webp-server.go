@@ -1,17 +1,21 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"os"
+	"os/signal"
 	"runtime"
+	"syscall"
+	"time"
 	"webp_server_go/config"
 	"webp_server_go/encoder"
 	"webp_server_go/handler"
+	"webp_server_go/metrics"
 	schedule "webp_server_go/schedule"
 
 	"github.com/gofiber/fiber/v2"
-	"github.com/gofiber/fiber/v2/middleware/etag"
 	"github.com/gofiber/fiber/v2/middleware/logger"
 	"github.com/gofiber/fiber/v2/middleware/recover"
 	log "github.com/sirupsen/logrus"
@@ -97,31 +101,111 @@ func init() {
 	setupLogger()
 }
 
+// newAdmin returns the admin API app, or nil if it's disabled because ADMIN_TOKEN is not set
+func newAdmin() *fiber.App {
+	if config.Config.AdminToken == "" {
+		log.Warn("ADMIN_TOKEN is not set, admin API is disabled")
+		return nil
+	}
+	admin := fiber.New(fiber.Config{
+		ServerHeader:          "WebP Server Go",
+		AppName:               "WebP Server Go Admin",
+		DisableStartupMessage: true,
+	})
+	admin.Use(handler.AdminAuth)
+	admin.Post("/purge", handler.Purge)
+	return admin
+}
+
+func startAdmin(admin *fiber.App) {
+	fmt.Println("WebP Server Go admin API is running on http://" + config.Config.AdminListen)
+	if err := admin.Listen(config.Config.AdminListen); err != nil {
+		log.Error("Error starting admin API: ", err)
+	}
+}
+
+// waitIdle waits until no conversion or background revalidation is in progress, returning false if ctx is done before that
+func waitIdle(ctx context.Context) bool {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for encoder.InProgress() > 0 || handler.Refreshing() > 0 {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-ticker.C:
+		}
+	}
+	return true
+}
+
+// shutdown stops accepting connections and waits up to SHUTDOWN_TIMEOUT for in-flight requests,
+// conversions(including prefetch) and downloads to finish.
+func shutdown(admin *fiber.App) {
+	log.Info("Shutting down, waiting for in-flight requests and conversions...")
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(config.Config.ShutdownTimeout)*time.Second)
+	defer cancel()
+
+	if admin != nil {
+		if err := admin.ShutdownWithContext(ctx); err != nil {
+			log.Warn("Error shutting down admin API: ", err)
+		}
+	}
+	if err := app.ShutdownWithContext(ctx); err != nil {
+		log.Warn("Error shutting down server: ", err)
+	}
+
+	if !waitIdle(ctx) {
+		// Files are renamed into place once complete, so nothing partial is left to be served after restart.
+		// libvips can't be shut down under running conversions
+		log.Warnf("In-flight conversions didn't finish in %d seconds, exiting anyway", config.Config.ShutdownTimeout)
+		return
+	}
+	encoder.Shutdown()
+	log.Info("Shutdown complete")
+}
+
 func main() {
-	go schedule.DeleteDeadCache()
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	go schedule.DeleteDeadCache(ctx)
+	go schedule.DeleteStaleExhaust(ctx)
 	if config.Config.MaxCacheSize != 0 {
-		go schedule.CleanCache()
+		go schedule.CleanCache(ctx)
 	}
 	if config.Prefetch {
-		go encoder.PrefetchImages()
+		go encoder.PrefetchImages(ctx)
 	} else if config.PrefetchForeground {
 		// Standalone prefetch, prefetch and exit
-		encoder.PrefetchImages()
+		encoder.PrefetchImages(ctx)
 		os.Exit(0)
 	}
-	app.Use(etag.New(etag.Config{
-		Weak: true,
-	}))
+	var admin *fiber.App
+	if config.Config.AdminListen != "" {
+		admin = newAdmin()
+		if admin != nil {
+			go startAdmin(admin)
+		}
+	}
 
 	listenAddress := config.Config.Host + ":" + config.Config.Port
 
 	app.Get("/healthz", handler.Healthz)
-	app.Get("/*", handler.Convert)
+	app.Get("/readyz", handler.Readyz)
+	app.Get("/metrics", metrics.Handler)
+	app.Get("/*", metrics.Instrument, handler.Convert)
 
 	fmt.Println("WebP Server Go is Running on http://" + listenAddress)
 
-	bindErr := app.Listen(listenAddress)
-	if bindErr != nil {
-		log.Fatal("Error starting server: ", bindErr)
-	}
+	go func() {
+		// Listen returns nil once shutdown is called
+		if bindErr := app.Listen(listenAddress); bindErr != nil {
+			log.Fatal("Error starting server: ", bindErr)
+		}
+	}()
+
+	<-ctx.Done()
+	// A second signal kills the process without waiting
+	stop()
+	shutdown(admin)
 }